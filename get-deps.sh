@@ -2,4 +2,3 @@
 export GOPATH=`pwd`
 go get bazil.org/fuse
 go get golang.org/x/net/context
-go get github.com/spacemonkeygo/openssl
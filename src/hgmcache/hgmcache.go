@@ -0,0 +1,107 @@
+/*
+ * Copyright (C) 2015 Adrian Ulrich <adrian@blinkenlights.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package hgmcache
+
+import (
+	"fmt"
+	"libhgms/ssc"
+	"strconv"
+	"strings"
+)
+
+/**
+ * Runs a maintenance command on the ssc database at dbpath, called by hgmcmd
+ * Returns false if the command failed
+ */
+func RunCommand(command string, dbpath string, args []string) bool {
+	cache, err := ssc.Open(dbpath)
+	if err != nil {
+		fmt.Printf("%s: %s\n", dbpath, err)
+		return false
+	}
+	defer cache.Close()
+
+	prefix := ""
+	if len(args) > 0 {
+		prefix = args[0]
+	}
+
+	switch command {
+	case "stats":
+		printStats(cache.Stats())
+		return true
+	case "verify":
+		return verifyEntries(cache)
+	case "clear":
+		fmt.Printf("Removed %d entries\n", cache.InvalidatePrefix(prefix))
+		return true
+	case "dump":
+		dumpEntries(cache, prefix)
+		return true
+	}
+	fmt.Printf("Unknown cache command: %s\n", command)
+	return false
+}
+
+// Prints the fill level and hit ratio of a cache
+func printStats(st ssc.Stats) {
+	fmt.Printf("Version    : %d\n", st.Version)
+	fmt.Printf("Chunks     : %d x %d bytes (%.2fMB)\n", st.ChunkCount, st.ChunkSize, float64(st.ChunkCount)*float64(st.ChunkSize)/1024/1024)
+	fmt.Printf("Used       : %d chunks (%.1f%%), %.2fMB of data\n", st.Used, percent(uint64(st.Used), uint64(st.ChunkCount)), float64(st.UsedBytes)/1024/1024)
+	fmt.Printf("Lookups    : %d hits, %d misses (%.1f%% hit ratio)\n", st.Hits, st.Misses, percent(st.Hits, st.Hits+st.Misses))
+}
+
+// Verifies the checksum of each entry, returns false if any entry is broken
+func verifyEntries(cache *ssc.Cache) bool {
+	checked, broken := 0, 0
+	for _, entry := range cache.Entries() {
+		err := cache.Verify(entry.Key)
+		if err == ssc.ErrNotCached {
+			continue // removed in between
+		}
+		checked++
+		if err != nil {
+			fmt.Printf("%s: %s\n", quoteKey(entry.Key), err)
+			broken++
+		}
+	}
+	fmt.Printf("Verified %d entries, %d broken\n", checked, broken)
+	return broken == 0
+}
+
+// Lists all entries starting with prefix, most recently used first
+func dumpEntries(cache *ssc.Cache, prefix string) {
+	for _, entry := range cache.Entries() {
+		if strings.HasPrefix(entry.Key, prefix) {
+			fmt.Printf("%-12d %8d %s\n", entry.Stamp, entry.Len, quoteKey(entry.Key))
+		}
+	}
+}
+
+// Returns key in a printable form: keys of hgmfs contain NUL bytes
+func quoteKey(key string) string {
+	quoted := strconv.Quote(key)
+	return quoted[1 : len(quoted)-1]
+}
+
+func percent(part uint64, total uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(part) * 100 / float64(total)
+}
@@ -19,16 +19,48 @@ package main
 
 import (
 	"encoding/hex"
+	"flag"
 	"fmt"
+	"hgmcache"
 	"hgmfs"
+	"hgmupload"
+	"hgmverify"
 	"hgmweb"
 	"libhgms/flickr/png"
 	"os"
+	"strconv"
+	"time"
 )
 
 func main() {
 	subModule := ""
 
+	proxyFlags := flag.NewFlagSet("proxy", flag.ExitOnError)
+	proxyOpts := hgmweb.ProxyOptions{}
+	proxyFlags.StringVar(&proxyOpts.UploadTarget, "upload-target", "", "allow clients to store new files at this target")
+	proxyFlags.StringVar(&proxyOpts.UploadLayout, "upload-layout", flickr.LAYOUT_ZLIB, "PNG layout of new blobs")
+	proxyFlags.IntVar(&proxyOpts.Prefetch, "prefetch", 1, "number of upcoming blobs to fetch in the background")
+	proxyFlags.StringVar(&proxyOpts.CachePath, "cache", "", "keep decrypted blobs in this cache file")
+	proxyFlags.IntVar(&proxyOpts.CacheSize, "cache-size", 512, "size of the blob cache in MB")
+	proxyFlags.BoolVar(&proxyOpts.CacheSync, "cache-sync", false, "flush each change of the blob cache to disk")
+	proxyFlags.StringVar(&proxyOpts.LocalRoot, "local-root", "", "serve blobs with file:// locations from this directory")
+	proxyFlags.BoolVar(&proxyOpts.Health, "health", false, "serve the health state of all hosts at .health")
+
+	mountFlags := flag.NewFlagSet("mount", flag.ExitOnError)
+	mountOpts := hgmfs.MountOptions{}
+	mountFlags.BoolVar(&mountOpts.DirectIO, "direct-io", true, "bypass the page cache of the kernel")
+	mountFlags.StringVar(&mountOpts.CachePath, "cache", "", "keep read blocks in this cache file")
+	mountFlags.IntVar(&mountOpts.CacheSize, "cache-size", 512, "size of the block cache in MB")
+	mountFlags.IntVar(&mountOpts.CacheBlockSize, "cache-block-size", 16384, "size of a single cached block in bytes")
+	mountFlags.BoolVar(&mountOpts.CacheSync, "cache-sync", false, "flush each change of the block cache to disk")
+	mountFlags.Int64Var(&mountOpts.MaxForward, "max-forward", 2*1024*1024, "skip up to this many bytes instead of opening a new connection")
+	mountFlags.DurationVar(&mountOpts.AttrTTL, "attr-ttl", time.Second, "how long to cache attributes of files and directories")
+	mountFlags.DurationVar(&mountOpts.NegativeTTL, "negative-ttl", time.Second, "how long to cache failed lookups")
+	mountFlags.DurationVar(&mountOpts.DirTTL, "dir-ttl", time.Second, "how long to cache directory listings")
+
+	verifyFlags := flag.NewFlagSet("verify", flag.ExitOnError)
+	verifyRoot := verifyFlags.String("local-root", "", "read blobs with file:// locations from this directory")
+
 	if len(os.Args) > 1 {
 		subModule = os.Args[1]
 	}
@@ -37,31 +69,117 @@ func main() {
 		flickr.CryptAes(strToSlice(os.Args[2]), strToSlice(os.Args[3]), os.Args[4], os.Args[5], true)
 	} else if subModule == "decrypt" && len(os.Args) == 6 {
 		flickr.CryptAes(strToSlice(os.Args[2]), strToSlice(os.Args[3]), os.Args[4], os.Args[5], false)
-	} else if subModule == "proxy" && len(os.Args) >= 4 {
-		webrootPrefix := ""
-		if len(os.Args) > 4 {
-			webrootPrefix = os.Args[4]
+	} else if subModule == "pack" && len(os.Args) == 7 {
+		contentSize, err := strconv.ParseInt(os.Args[3], 10, 64)
+		if err != nil {
+			fmt.Printf("Invalid contentsize: %s\n", err)
+			os.Exit(1)
+		}
+		blobSize, err := strconv.ParseInt(os.Args[4], 10, 64)
+		if err != nil {
+			fmt.Printf("Invalid blobsize: %s\n", err)
+			os.Exit(1)
+		}
+		flickr.PackFile(strToSlice(os.Args[2]), contentSize, blobSize, os.Args[5], os.Args[6])
+	} else if subModule == "proxy" && proxyFlags.Parse(os.Args[2:]) == nil && proxyFlags.NArg() >= 2 {
+		proxyOpts.BindAddr, proxyOpts.BindPort = proxyFlags.Arg(0), proxyFlags.Arg(1)
+		if proxyFlags.NArg() > 2 {
+			proxyOpts.Prefix = proxyFlags.Arg(2)
 		}
-		hgmweb.LaunchProxy(os.Args[2], os.Args[3], webrootPrefix)
-	} else if subModule == "mount" && len(os.Args) >= 3 {
-		proxyUrl := "http://localhost:8080/"
-		if len(os.Args) > 3 {
-			proxyUrl = os.Args[3]
+		hgmweb.LaunchProxy(proxyOpts)
+	} else if subModule == "mount" && mountFlags.Parse(os.Args[2:]) == nil && mountFlags.NArg() >= 1 {
+		mountOpts.Mountpoint, mountOpts.ProxyURL = mountFlags.Arg(0), "http://localhost:8080/"
+		if mountFlags.NArg() > 1 {
+			mountOpts.ProxyURL = mountFlags.Arg(1)
+		}
+		hgmfs.MountFilesystem(mountOpts)
+	} else if subModule == "upload" {
+		upFlags := flag.NewFlagSet("upload", flag.ExitOnError)
+		replicate := upFlags.Bool("replicate", false, "add a new copy of already uploaded files")
+		dryRun := upFlags.Bool("dry-run", false, "do not create metadata for new files")
+		target := upFlags.String("target", "flickr", "where to store the encrypted blobs")
+		layout := upFlags.String("layout", flickr.LAYOUT_ZLIB, "PNG layout of new blobs")
+		upFlags.Parse(os.Args[2:])
+		hgmupload.UploadFiles(upFlags.Args(), *target, *layout, *replicate, *dryRun)
+	} else if subModule == "verify" && verifyFlags.Parse(os.Args[2:]) == nil && verifyFlags.NArg() >= 1 {
+		if hgmverify.VerifyFiles(verifyFlags.Args(), *verifyRoot) == false {
+			os.Exit(1)
+		}
+	} else if subModule == "cache" && len(os.Args) >= 4 {
+		if hgmcache.RunCommand(os.Args[2], os.Args[3], os.Args[4:]) == false {
+			os.Exit(1)
 		}
-		hgmfs.MountFilesystem(os.Args[2], proxyUrl)
 	} else {
 
-		fmt.Printf("Usage: %s proxy | mount | encrypt | decrypt\n\n", os.Args[0])
-		fmt.Printf(`proxy binaddr bindport [prefix]
+		fmt.Printf("Usage: %s proxy | mount | upload | verify | cache | encrypt | decrypt | pack\n\n", os.Args[0])
+		fmt.Printf(`proxy [--upload-target=url] [--upload-layout=zlib|stored] [--prefetch=N] [--cache=path [--cache-size=MB] [--cache-sync]] [--local-root=dir] [--health]
+      binaddr bindport [prefix]
+	--upload-target : Accept new files from clients and store them at this target (see upload)
+	--upload-layout : PNG layout of new files (see upload)
+	--prefetch      : Number of upcoming blobs to fetch while streaming, 0 disables read-ahead (default: 1)
+	--cache         : Keep decrypted blobs in this file, eg: ./proxy-cache.db
+	--cache-size    : Size of the cache in MB (default: 512)
+	--cache-sync    : Flush each change of the cache to disk: slower, but nothing is lost on a crash
+	--local-root    : Serve blobs with file:// locations from this directory, others are rejected
+	                  (blobs stored at a file:// --upload-target are always served)
+	--health        : Serve the health state of all hosts at <prefix>.health, it lists the hosts storing your blobs
 	bindaddr    : IPv4 address to bind to, eg: 127.0.0.1
 	bindport    : Port to use, eg: 8080
 	prefix      : Webroot prefix, eg: secret-location/
 
 `)
 
-		fmt.Printf(`mount target [proxy-url]
+		fmt.Printf(`mount [--direct-io=true|false] [--cache=path [--cache-size=MB] [--cache-block-size=bytes] [--cache-sync]] [--max-forward=bytes]
+      [--attr-ttl=duration] [--negative-ttl=duration] [--dir-ttl=duration] target [proxy-url]
+	--direct-io        : Bypass the page cache of the kernel (default: true)
+	--cache            : Keep read blocks in this file, eg: ./ssc.db
+	--cache-size       : Size of the cache in MB (default: 512)
+	--cache-block-size : Size of a single cached block (default: 16384)
+	--cache-sync       : Flush each change of the cache to disk: slower, but nothing is lost on a crash
+	--max-forward      : Skip up to this many bytes on an open connection instead of opening a new one (default: 2097152)
+	--attr-ttl         : How long attributes of files and directories are cached, eg: 500ms (default: 1s)
+	--negative-ttl     : How long failed lookups of missing files are cached (default: 1s)
+	--dir-ttl          : How long directory listings are cached (default: 1s)
 	target      : Mountpoint directory
 	proxy-url   : URL of the launched hgms proxy, defaults to http://localhost:8080/
+	All settings may be changed while mounted by writing 'name=value' lines to target/.hgmfs-control,
+	eg: echo cache_size=1024 > target/.hgmfs-control
+
+`)
+
+		fmt.Printf(`upload [--replicate] [--dry-run] [--target=url] [--layout=zlib|stored] [file ...]
+	--replicate : Add a new copy of files which were already uploaded
+	--dry-run   : Only replicate existing files, do not upload new ones
+	--target    : Where to store the blobs: 'flickr' (default) or file:///some/directory
+	--layout    : 'zlib' (default) compresses the PNG data, 'stored' allows the proxy
+	              to download only the requested part of a blob
+	file        : Files to upload, paths are read from stdin if omitted
+
+`)
+
+		fmt.Printf(`verify [--local-root=dir] alias ...
+	--local-root : Read blobs with file:// locations from this directory, others are rejected
+	alias       : Json file (or directory of json files) in ./_aliases, all replicas
+	              are downloaded and compared with the digest recorded during upload
+
+`)
+
+		fmt.Printf(`cache stats|verify|clear|dump database [prefix]
+	stats       : Show the fill level and hit ratio of a cache
+	verify      : Check all entries, exits with an error if any of them is broken
+	clear       : Remove all entries starting with prefix (or all entries)
+	dump        : List all entries starting with prefix, most recently used first
+	database    : Cache file used by the proxy (--cache) or ./ssc.db of a mount
+	              the cache must not be in use
+
+`)
+
+		fmt.Printf(`pack iv contentsize blobsize infile outfile
+	iv          : IV used to encrypt infile (hex string)
+	contentsize : Size of the unencrypted file
+	blobsize    : Size of the unencrypted part stored in infile
+	infile      : Encrypted input file
+	outfile     : PNG file to create
 
 `)
 	}
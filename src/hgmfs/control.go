@@ -0,0 +1,262 @@
+package hgmfs
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"bytes"
+	"fmt"
+	"golang.org/x/net/context"
+	"libhgms/ssc"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Name of the control file in the root of the mount: reading it returns the
+// current settings, writing 'name=value' lines to it changes them
+const controlName = ".hgmfs-control"
+
+type HgmControl struct{}
+
+func (ctl HgmControl) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = 0600
+	a.Uid = uint32(os.Getuid())
+	a.Gid = uint32(os.Getgid())
+	return nil
+}
+
+func (ctl HgmControl) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	resp.Flags |= fuse.OpenDirectIO // our size is unknown
+	return &controlHandle{}, nil
+}
+
+// An open control file: lines may be split across multiple writes, so
+// incomplete lines are kept until they are completed or the file is closed
+type controlHandle struct {
+	mutex   sync.Mutex
+	pending []byte
+}
+
+// Accepts truncate(), issued when the file is opened with O_TRUNC
+func (ctl HgmControl) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	return ctl.Attr(ctx, &resp.Attr)
+}
+
+/**
+ * Returns the current settings and some statistics
+ */
+func (ch *controlHandle) ReadAll(ctx context.Context) ([]byte, error) {
+	settingsLock.RLock()
+	defer settingsLock.RUnlock()
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "direct_io=%t\n", useDirectIO)
+	fmt.Fprintf(buf, "cache=%s\n", lruCachePath)
+	fmt.Fprintf(buf, "cache_size=%d\n", int64(lruBlockSize)*int64(lruMaxItems)/1024/1024)
+	fmt.Fprintf(buf, "cache_block_size=%d\n", lruBlockSize)
+	fmt.Fprintf(buf, "cache_sync=%t\n", lruSyncWrites)
+	fmt.Fprintf(buf, "max_forward=%d\n", maxFwdBytes)
+	fmt.Fprintf(buf, "attr_ttl=%s\n", attrTTL)
+	fmt.Fprintf(buf, "negative_ttl=%s\n", negativeTTL)
+	fmt.Fprintf(buf, "dir_ttl=%s\n", dirTTL)
+	fmt.Fprintf(buf, "# bytes_hit=%d bytes_miss=%d\n", hgmStats.bytesHit, hgmStats.bytesMiss)
+	return buf.Bytes(), nil
+}
+
+/**
+ * Applies each complete 'name=value' line written to the control file
+ */
+func (ch *controlHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+
+	ch.pending = append(ch.pending, req.Data...)
+	resp.Size = len(req.Data)
+
+	end := bytes.LastIndexByte(ch.pending, '\n')
+	if end < 0 {
+		return nil
+	}
+	lines := string(ch.pending[:end])
+	ch.pending = append([]byte(nil), ch.pending[end+1:]...)
+	return applyLines(lines)
+}
+
+/**
+ * Applies the last line if it was not terminated, called on each close()
+ */
+func (ch *controlHandle) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+
+	lines := string(ch.pending)
+	ch.pending = nil
+	return applyLines(lines)
+}
+
+// Applies each 'name=value' line of lines, stops at the first invalid one
+func applyLines(lines string) error {
+	for _, line := range strings.Split(lines, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return fuse.Errno(syscall.EINVAL)
+		}
+		if err := applySetting(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])); err != nil {
+			fmt.Printf("control: failed to set '%s': %s\n", line, err)
+			return fuse.Errno(syscall.EINVAL)
+		}
+		fmt.Printf("control: %s\n", line)
+	}
+	return nil
+}
+
+// Changes a single setting
+func applySetting(name string, value string) error {
+	switch name {
+	case "cache", "cache_size", "cache_block_size", "cache_sync":
+		return applyCacheSetting(name, value)
+	}
+
+	settingsLock.Lock()
+	defer settingsLock.Unlock()
+
+	var err error
+	switch name {
+	case "direct_io":
+		useDirectIO, err = strconv.ParseBool(value)
+	case "max_forward":
+		maxFwdBytes, err = strconv.ParseInt(value, 10, 64)
+	case "attr_ttl":
+		attrTTL, err = time.ParseDuration(value)
+	case "negative_ttl":
+		negativeTTL, err = time.ParseDuration(value)
+	case "dir_ttl":
+		dirTTL, err = time.ParseDuration(value)
+	default:
+		return fmt.Errorf("unknown setting")
+	}
+	return err
+}
+
+// Changes a setting of the LRU cache, which gets reopened
+func applyCacheSetting(name string, value string) error {
+	lruSetupLock.Lock()
+	defer lruSetupLock.Unlock()
+
+	settingsLock.RLock()
+	cachePath, blockSize, cacheSize := lruCachePath, int64(lruBlockSize), int64(lruBlockSize)*int64(lruMaxItems)/1024/1024
+	syncWrites := lruSyncWrites
+	settingsLock.RUnlock()
+
+	var err error
+	switch name {
+	case "cache":
+		cachePath = value
+	case "cache_size":
+		cacheSize, err = strconv.ParseInt(value, 10, 64)
+	case "cache_block_size":
+		blockSize, err = strconv.ParseInt(value, 10, 64)
+	case "cache_sync":
+		syncWrites, err = strconv.ParseBool(value)
+	}
+	if err != nil {
+		return err
+	}
+	return setupLruCache(cachePath, cacheSize, blockSize, syncWrites)
+}
+
+// Serializes changes of the LRU cache, taken before settingsLock
+var lruSetupLock sync.Mutex
+
+// Opens the LRU cache at path with the given size in MB, replacing the current one.
+// An empty path disables the cache, syncWrites flushes each change to disk
+// Must be called while holding lruSetupLock
+func setupLruCache(path string, sizeMB int64, blockSize int64, syncWrites bool) error {
+	if blockSize <= 0 || blockSize > 1024*1024*16 {
+		return fmt.Errorf("invalid block size %d", blockSize)
+	}
+	maxItems := sizeMB * 1024 * 1024 / blockSize
+	if maxItems <= 0 || maxItems > 1<<32-1 {
+		return fmt.Errorf("invalid cache size of %dMB", sizeMB)
+	}
+
+	closeLruCache() // the database is locked while open: close it before it gets reopened
+
+	var handle *lruHandle
+	if len(path) > 0 {
+		cache, err := ssc.New(path, uint32(blockSize), uint32(maxItems))
+		if err != nil {
+			settingsLock.Lock()
+			lruCachePath = "" // the cache stays disabled
+			settingsLock.Unlock()
+			return err
+		}
+		if syncWrites {
+			cache.Sync = ssc.SYNC_WRITES
+		}
+		handle = &lruHandle{Cache: cache, blockSize: uint32(blockSize)}
+	}
+
+	settingsLock.Lock()
+	defer settingsLock.Unlock()
+	lruCachePath, lruBlockSize, lruMaxItems, lruSyncWrites = path, uint32(blockSize), uint32(maxItems), syncWrites
+	lruCache = handle
+	return nil
+}
+
+// Disables the LRU cache and closes it once its last user released it, marking its
+// database as cleanly closed. Readers are not blocked while we wait for them
+// Must be called while holding lruSetupLock
+func closeLruCache() {
+	settingsLock.Lock()
+	cache := lruCache
+	lruCache = nil
+	settingsLock.Unlock()
+
+	if cache != nil {
+		cache.users.Wait()
+		cache.Close()
+	}
+}
+
+// The LRU cache and the block size it was opened with. It may be used without
+// holding settingsLock by everyone who acquired it via acquireReadSettings
+type lruHandle struct {
+	*ssc.Cache
+	blockSize uint32
+	users     sync.WaitGroup
+}
+
+// The settings used by a single read, taken when the read starts: reads do not
+// hold settingsLock while talking to the proxy
+type readSettings struct {
+	cache     *lruHandle // nil if the LRU cache is disabled
+	blockSize uint32
+	maxFwd    int64
+}
+
+// Returns a snapshot of the current settings, the LRU cache is kept open until
+// the returned settings are released
+func acquireReadSettings() readSettings {
+	settingsLock.RLock()
+	defer settingsLock.RUnlock()
+
+	if lruCache != nil {
+		lruCache.users.Add(1)
+	}
+	return readSettings{cache: lruCache, blockSize: lruBlockSize, maxFwd: maxFwdBytes}
+}
+
+// Allows the LRU cache to be closed again
+func (rs readSettings) release() {
+	if rs.cache != nil {
+		rs.cache.users.Done()
+	}
+}
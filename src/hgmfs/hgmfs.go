@@ -5,16 +5,20 @@ import (
 	"bazil.org/fuse/fs"
 	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"golang.org/x/net/context"
 	"io"
 	"io/ioutil"
-	"libhgms/ssc"
 	"libhgms/stattool"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -22,6 +26,12 @@ import (
 type HgmFs struct {
 	mountPoint string
 	proxyUrl   string
+	caps       *proxyCaps // shared by all nodes of the mount
+}
+
+// What we learned about the proxy while talking to it
+type proxyCaps struct {
+	noReadDirPlus int32 // set to 1 (atomically) once the proxy did not understand readdirplus
 }
 
 type HgmDir struct {
@@ -29,23 +39,46 @@ type HgmDir struct {
 	localDir string
 }
 
+// A file node, shared by all open handles of the file
 type HgmFile struct {
 	hgmFs     HgmFs
 	localFile string
 	fileSize  uint64
+	mutex     sync.Mutex // protects all fields below and fileSize
+	stage     *os.File   // Local copy of the file while it is being written, may be nil
+	dirty     bool       // True if 'stage' holds changes which were not committed yet
+	writers   int        // Number of open write handles
+	version   uint64     // Incremented on each commit, tells handles that the content was replaced
+}
+
+// An open file, each open() gets its own connection to the proxy
+type HgmFileHandle struct {
+	file      *HgmFile
+	mutex     sync.Mutex     // serializes reads, protects all fields below
 	resp      *http.Response // An HTTP connection, may be nil
 	bbody     *bufio.Reader
 	connected bool
-	offset    int64 // Current offset of 'resp'
+	offset    int64  // Current offset of 'resp'
+	etag      string // ETag of the content we are reading, used to detect changes while the file is open
+	version   uint64 // version of the file which etag belongs to
 }
 
+// Settings of the mount, they may be changed at any time through the control file
+var settingsLock sync.RWMutex // protects the settings below
 var useDirectIO = bool(true)
-var lruEnabled = bool(false)
+var lruCachePath = "" // where the LRU cache is stored, disabled if empty
 var lruBlockSize = uint32(16384)
 var lruMaxItems = uint32(32768) // how many lruBlockSize sized items we are storing
-var lruCache *ssc.Cache
+var lruSyncWrites = false       // flush each change of the LRU cache to disk
+var lruCache *lruHandle
+var maxFwdBytes = int64(1024 * 1024 * 2) // never fast-forward more than this
+var attrTTL = time.Second                // how long attributes and found entries are cached
+var negativeTTL = time.Second            // how long failed lookups are cached
+var dirTTL = time.Second                 // how long directory listings are cached
 
-var maxFwdBytes = int64(1024 * 1024 * 2) // never fast-forward more than 2MB
+var stagingDir = os.TempDir() // where written files are kept until they are committed
+
+var errNoReadDirPlus = errors.New("proxy does not support readdirplus")
 
 var httpClient = &http.Client{Transport: &http.Transport{ResponseHeaderTimeout: 15 * time.Second, Proxy: http.ProxyFromEnvironment}}
 
@@ -56,12 +89,29 @@ var hgmStats = struct {
 	bytesMiss  int64
 }{}
 
+// Settings of a mount, see MountFilesystem
+type MountOptions struct {
+	Mountpoint     string
+	ProxyURL       string        // URL of the hgms proxy serving the files
+	DirectIO       bool          // bypass the page cache of the kernel
+	CachePath      string        // file of the LRU cache, disabled if empty
+	CacheSize      int           // size of the LRU cache in MB
+	CacheBlockSize int           // size of a single cached block in bytes
+	CacheSync      bool          // flush each change of the LRU cache to disk
+	MaxForward     int64         // skip up to this many bytes instead of opening a new connection
+	AttrTTL        time.Duration // how long attributes and found entries are cached
+	NegativeTTL    time.Duration // how long failed lookups are cached
+	DirTTL         time.Duration // how long directory listings are cached
+}
+
 /**
  * Initialized the mount process, called by hgmcmd
  */
-func MountFilesystem(mountpoint string, proxy string) {
+func MountFilesystem(opts MountOptions) {
+	mountpoint := opts.Mountpoint
 
 	// The proxy URL should end with a slash, add it if the user forgot about this
+	proxy := opts.ProxyURL
 	if proxy[len(proxy)-1] != '/' {
 		proxy += "/"
 	}
@@ -78,16 +128,27 @@ func MountFilesystem(mountpoint string, proxy string) {
 	}
 	defer c.Close()
 
-	if lruEnabled == true {
-		lruCache, err = ssc.New("./ssc.db", lruBlockSize, lruMaxItems)
-		if err != nil {
-			log.Fatal(err)
-		}
+	settingsLock.Lock()
+	useDirectIO = opts.DirectIO
+	maxFwdBytes = opts.MaxForward
+	attrTTL, negativeTTL, dirTTL = opts.AttrTTL, opts.NegativeTTL, opts.DirTTL
+	settingsLock.Unlock()
+
+	lruSetupLock.Lock()
+	err = setupLruCache(opts.CachePath, int64(opts.CacheSize), int64(opts.CacheBlockSize), opts.CacheSync)
+	lruSetupLock.Unlock()
+	if err != nil {
+		log.Fatal(err)
 	}
+	defer func() {
+		lruSetupLock.Lock()
+		closeLruCache()
+		lruSetupLock.Unlock()
+	}()
 
-	fmt.Printf("Serving FS at '%s' (lru_cache=%.2fMB)\n", mountpoint, float64(lruBlockSize*lruMaxItems/1024/1024))
+	fmt.Printf("Serving FS at '%s' (lru_cache=%s, direct_io=%t)\n", mountpoint, opts.CachePath, opts.DirectIO)
 
-	err = fs.Serve(c, HgmFs{mountPoint: mountpoint, proxyUrl: proxy})
+	err = fs.Serve(c, HgmFs{mountPoint: mountpoint, proxyUrl: proxy, caps: &proxyCaps{}})
 
 	if err != nil {
 		log.Fatal(err)
@@ -110,11 +171,24 @@ func (fs HgmFs) Root() (fs.Node, error) {
 /**
  * Stat()'s the current directory
  */
-func (dir HgmDir) Attr(ctx context.Context, a *fuse.Attr) error {
-	resp, err := httpClient.Get(dir.getStatEndpoint(dir.localDir, false))
+func (dir *HgmDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	path := dir.path()
+	if attr, err, ok := cachedStat(path); ok {
+		*a = attr
+		return err
+	}
+	err := dir.fetchAttr(path, a)
+	storeStat(path, a, err)
+	return err
+}
+
+// Asks the stat service for the attributes of path
+func (dir *HgmDir) fetchAttr(path string, a *fuse.Attr) error {
+	resp, err := httpClient.Get(dir.getStatEndpoint(path, ""))
 	if err != nil {
 		return fuse.EIO
 	}
+	defer resp.Body.Close()
 
 	fuseErr := stattool.HttpStatusToFuseErr(resp.StatusCode)
 	if fuseErr == nil {
@@ -139,16 +213,31 @@ func (dir HgmDir) Attr(ctx context.Context, a *fuse.Attr) error {
  */
 func (file *HgmFile) Attr(ctx context.Context, a *fuse.Attr) error {
 	// The directory stat implementation also works for files
-	d := HgmDir{hgmFs: file.hgmFs, localDir: file.localFile}
+	d := HgmDir{hgmFs: file.hgmFs, localDir: file.path()}
 	err := d.Attr(ctx, a)
+
+	file.mutex.Lock()
+	defer file.mutex.Unlock()
+	if file.stage != nil {
+		// We are writing to this file: the proxy may not even know about it yet
+		if err != nil {
+			*a = fuse.Attr{Mode: 0644, Mtime: time.Now()}
+			err = nil
+		}
+		a.Size = file.fileSize
+		a.Valid = 0 // changes with each write
+	}
 	return err
 }
 
 /**
  * Performs a lookup-op and returns a file or dir-handle, depending on the file type
  */
-func (dir HgmDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
-	localDirent := dir.localDir + name // dirs are ending with a slash -> just append the name
+func (dir *HgmDir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
+	localDirent := dir.path() + req.Name // dirs are ending with a slash -> just append the name
+	if localDirent == "/"+controlName {
+		return HgmControl{}, nil
+	}
 	a := fuse.Attr{}
 	d := HgmDir{hgmFs: dir.hgmFs, localDir: localDirent}
 	err := d.Attr(ctx, &a)
@@ -156,12 +245,51 @@ func (dir HgmDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
 	if err != nil {
 		return nil, err
 	}
+	resp.EntryValid = a.Valid // the kernel may skip lookups as long as we would answer them from our cache
 
 	if (a.Mode & os.ModeType) == os.ModeDir {
-		return HgmDir{hgmFs: dir.hgmFs, localDir: localDirent + "/"}, nil
+		return registerNode(localDirent+"/", &HgmDir{hgmFs: dir.hgmFs, localDir: localDirent + "/"}, false), nil
 	}
 
-	return &HgmFile{hgmFs: dir.hgmFs, localFile: localDirent, fileSize: a.Size}, nil
+	node := registerNode(localDirent, &HgmFile{hgmFs: dir.hgmFs, localFile: localDirent, fileSize: a.Size}, false)
+	if file, ok := node.(*HgmFile); ok {
+		file.mutex.Lock()
+		if file.stage == nil {
+			file.fileSize = a.Size // the file may have changed since we saw it for the last time
+		}
+		file.mutex.Unlock()
+	}
+	return node, nil
+}
+
+// Returns the path of this directory
+func (dir *HgmDir) path() string {
+	nodeRegistry.RLock()
+	defer nodeRegistry.RUnlock()
+	return dir.localDir
+}
+
+func (dir *HgmDir) setPath(path string) {
+	dir.localDir = path
+}
+
+func (dir *HgmDir) Forget() {
+	forgetNode(dir.path(), dir)
+}
+
+// Returns the path of this file
+func (file *HgmFile) path() string {
+	nodeRegistry.RLock()
+	defer nodeRegistry.RUnlock()
+	return file.localFile
+}
+
+func (file *HgmFile) setPath(path string) {
+	file.localFile = path
+}
+
+func (file *HgmFile) Forget() {
+	forgetNode(file.path(), file)
 }
 
 /**
@@ -169,39 +297,160 @@ func (dir HgmDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
  */
 func (file *HgmFile) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
 	if !req.Flags.IsReadOnly() {
-		return nil, fuse.Errno(syscall.EACCES)
+		err := file.openStage(req.Flags&fuse.OpenTruncate != 0)
+		if err != nil {
+			return nil, err
+		}
 	}
 
+	settingsLock.RLock()
 	if useDirectIO == true {
 		resp.Flags |= fuse.OpenDirectIO
 	} else {
 		resp.Flags |= fuse.OpenKeepCache
 	}
-	return file, nil
+	settingsLock.RUnlock()
+	return &HgmFileHandle{file: file}, nil
 }
 
 /**
- * Dummy-out common write requests
+ * Creates a new file, its content is sent to the proxy on close
  */
 func (dir *HgmDir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
-	return nil, nil, fuse.Errno(syscall.EROFS)
+	localDirent := dir.path() + req.Name
+	file := &HgmFile{hgmFs: dir.hgmFs, localFile: localDirent}
+	err := file.openStage(true)
+	if err != nil {
+		return nil, nil, err
+	}
+	registerNode(localDirent, file, true)
+	invalidateStat(localDirent)
+	resp.EntryValid = 0 // does not exist until it gets committed
+
+	settingsLock.RLock()
+	if useDirectIO == true {
+		resp.Flags |= fuse.OpenDirectIO
+	}
+	settingsLock.RUnlock()
+	return file, &HgmFileHandle{file: file}, nil
 }
+
+/**
+ * Creates a new directory
+ */
+func (dir *HgmDir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
+	localDirent := dir.path() + req.Name
+	err := dir.hgmFs.modify("MKCOL", localDirent, nil)
+	invalidateStat(localDirent)
+	if err != nil {
+		return nil, err
+	}
+	return registerNode(localDirent+"/", &HgmDir{hgmFs: dir.hgmFs, localDir: localDirent + "/"}, true), nil
+}
+
+/**
+ * Removes a file or an empty directory
+ */
 func (dir *HgmDir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
-	return fuse.Errno(syscall.EROFS)
+	localDirent := dir.path() + req.Name
+	err := dir.hgmFs.modify("DELETE", localDirent, nil)
+	invalidateStat(localDirent)
+	if err == nil {
+		removeNode(localDirent)
+	}
+	return err
 }
+
+/**
+ * Moves a file or directory, the target may live in another directory
+ */
 func (dir *HgmDir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
-	return fuse.Errno(syscall.EROFS)
+	targetDir, ok := newDir.(*HgmDir)
+	if !ok {
+		return fuse.EIO
+	}
+	oldPath := dir.path() + req.OldName
+	newPath := targetDir.path() + req.NewName
+
+	header := http.Header{}
+	header.Set("Destination", dir.hgmFs.proxyLink(newPath))
+	err := dir.hgmFs.modify("MOVE", oldPath, header)
+	invalidateStat(oldPath)
+	invalidateStat(newPath)
+	if err == nil {
+		moveNodes(oldPath, newPath)
+	}
+	return err
 }
 
 /**
  * Returns a complete directory list
  */
 
-func (dir HgmDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
-	resp, err := httpClient.Get(dir.getStatEndpoint(dir.localDir, true))
+func (dir *HgmDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	path := dir.path()
+	if dirents, ok := cachedDirents(path); ok {
+		return dirents, nil
+	}
+
+	dirents, err := []fuse.Dirent(nil), errNoReadDirPlus
+	if atomic.LoadInt32(&dir.hgmFs.caps.noReadDirPlus) == 0 {
+		dirents, err = dir.readDirPlus(path)
+	}
+	if err == errNoReadDirPlus {
+		// there is no need to ask again
+		atomic.StoreInt32(&dir.hgmFs.caps.noReadDirPlus, 1)
+		dirents, err = dir.readDir(path)
+	}
+	if err == nil {
+		storeDirents(path, dirents)
+	}
+	return dirents, err
+}
+
+// Lists the directory at path and caches the attributes of all entries, using a single request
+func (dir *HgmDir) readDirPlus(path string) ([]fuse.Dirent, error) {
+	resp, err := httpClient.Get(dir.getStatEndpoint(path, "readdirplus"))
 	if err != nil {
 		return nil, fuse.EIO
 	}
+	defer resp.Body.Close()
+
+	if fuseErr := stattool.HttpStatusToFuseErr(resp.StatusCode); fuseErr != nil {
+		return nil, fuseErr
+	}
+
+	hgmDirList := []stattool.HgmStatDirentPlus{}
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fuse.EIO
+	}
+	if json.Unmarshal(bodyBytes, &hgmDirList) != nil {
+		return nil, errNoReadDirPlus // older proxies return the attributes of the directory itself
+	}
+
+	fuseDirList := make([]fuse.Dirent, 0, len(hgmDirList))
+	for _, v := range hgmDirList {
+		fuseType := fuse.DT_File
+		if v.Attr.IsDir == true {
+			fuseType = fuse.DT_Dir
+		}
+		fuseDirList = append(fuseDirList, fuse.Dirent{Inode: 0, Name: v.Name, Type: fuseType})
+
+		a := fuse.Attr{}
+		stattool.AttrFromHgmStat(v.Attr, &a)
+		storeStat(path+v.Name, &a, nil) // saves a lookup of each entry
+	}
+	return fuseDirList, nil
+}
+
+// Lists the directory at path
+func (dir *HgmDir) readDir(path string) ([]fuse.Dirent, error) {
+	resp, err := httpClient.Get(dir.getStatEndpoint(path, "readdir"))
+	if err != nil {
+		return nil, fuse.EIO
+	}
+	defer resp.Body.Close()
 
 	fuseDirList := make([]fuse.Dirent, 0)
 	fuseErr := stattool.HttpStatusToFuseErr(resp.StatusCode)
@@ -230,58 +479,322 @@ func (dir HgmDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 }
 
 // Returns URL to query the stat service
-func (dir HgmDir) getStatEndpoint(path string, readdir bool) string {
+func (dir *HgmDir) getStatEndpoint(path string, op string) string {
 	pathUrl := url.URL{Path: path}
 	endpoint := fmt.Sprintf("%s%s%s", dir.hgmFs.proxyUrl, stattool.StatSvcEndpoint, pathUrl.String())
-	if readdir == true {
-		endpoint += "?op=readdir"
+	if len(op) > 0 {
+		endpoint += "?op=" + op
 	}
 	return endpoint
 }
 
-func (file *HgmFile) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
-	file.resetHandle()
+// Returns the proxy URL of given path
+func (fs HgmFs) proxyLink(path string) string {
+	linkURL := &url.URL{Path: path}
+	linkName := linkURL.String()
+	// skip first char in filename as this would be the fs root (/)
+	return fmt.Sprintf("%s%s", fs.proxyUrl, linkName[1:])
+}
+
+// Sends a request modifying the alias tree to the proxy
+func (fs HgmFs) modify(method string, path string, header http.Header) error {
+	req, err := http.NewRequest(method, fs.proxyLink(path), nil)
+	if err != nil {
+		return fuse.EIO
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fuse.EIO
+	}
+	resp.Body.Close()
+	return stattool.HttpStatusToFuseErr(resp.StatusCode)
+}
+
+func (fh *HgmFileHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	var err error
+	if !req.Flags.IsReadOnly() {
+		err = fh.file.closeStage()
+	}
+	fh.mutex.Lock()
+	fh.resetHandle()
+	fh.mutex.Unlock()
+	return err
+}
+
+/**
+ * Commits pending writes, called on each close() of a file descriptor
+ */
+func (fh *HgmFileHandle) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	file := fh.file
+	file.mutex.Lock()
+	defer file.mutex.Unlock()
+	return file.commit()
+}
+
+func (file *HgmFile) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
+	file.mutex.Lock()
+	defer file.mutex.Unlock()
+	return file.commit()
+}
+
+func (fh *HgmFileHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	file := fh.file
+	file.mutex.Lock()
+	defer file.mutex.Unlock()
+
+	if file.stage == nil {
+		return fuse.Errno(syscall.EBADF)
+	}
+
+	nw, err := file.stage.WriteAt(req.Data, req.Offset)
+	resp.Size = nw
+	if end := uint64(req.Offset) + uint64(nw); end > file.fileSize {
+		file.fileSize = end
+	}
+	file.dirty = true
+
+	if err != nil {
+		return fuse.EIO
+	}
 	return nil
 }
 
-func (file *HgmFile) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
-	rqid := req.Handle
+/**
+ * Handles truncate() - the only attribute we are able to change
+ */
+func (file *HgmFile) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	if req.Valid.Size() {
+		err := file.truncate(req.Size)
+		if err != nil {
+			return err
+		}
+	}
+	return file.Attr(ctx, &resp.Attr)
+}
+
+// Changes the size of the file to size bytes
+func (file *HgmFile) truncate(size uint64) error {
+	err := file.openStage(size == 0)
+	if err != nil {
+		return err
+	}
+
+	file.mutex.Lock()
+	err = file.stage.Truncate(int64(size))
+	if err == nil {
+		file.fileSize = size
+		file.dirty = true
+	}
+	file.mutex.Unlock()
+
+	// Truncate is not required to happen on an open file, so commit if there is no writer left
+	if cerr := file.closeStage(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fuse.EIO
+	}
+	return nil
+}
+
+// Registers a new writer of file, creating a local copy of the file if needed
+// The current content of the file is fetched from the proxy unless it is going to be truncated
+func (file *HgmFile) openStage(truncate bool) error {
+	file.mutex.Lock()
+	defer file.mutex.Unlock()
+
+	if file.stage == nil {
+		stage, err := ioutil.TempFile(stagingDir, "hgmfs-stage")
+		if err != nil {
+			return fuse.EIO
+		}
+		os.Remove(stage.Name()) // we only need the filehandle
+
+		if truncate == false && file.fileSize > 0 {
+			err = file.fetchInto(stage)
+			if err != nil {
+				stage.Close()
+				return err
+			}
+		}
+
+		file.stage = stage
+		file.dirty = false
+	}
+
+	if truncate == true && file.fileSize != 0 {
+		file.stage.Truncate(0)
+		file.fileSize = 0
+		file.dirty = true
+	} else if file.fileSize == 0 {
+		// new (or empty) files shall be created on commit
+		file.dirty = true
+	}
+
+	file.writers++
+	return nil
+}
+
+// Unregisters a writer, the local copy is committed and dropped if it was the last one
+func (file *HgmFile) closeStage() error {
+	file.mutex.Lock()
+	defer file.mutex.Unlock()
+
+	err := file.commit()
+	if file.writers > 0 {
+		file.writers--
+	}
+	if file.writers == 0 && file.stage != nil {
+		file.stage.Close()
+		file.stage = nil
+	}
+	return err
+}
+
+// Copies the current content of the file on the proxy into stage
+func (file *HgmFile) fetchInto(stage *os.File) error {
+	resp, err := httpClient.Get(file.hgmFs.proxyLink(file.path()))
+	if err != nil {
+		return fuse.EIO
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return stattool.HttpStatusToFuseErr(resp.StatusCode)
+	}
+
+	nw, err := io.Copy(stage, resp.Body)
+	if err != nil || uint64(nw) != file.fileSize {
+		return fuse.EIO
+	}
+	return nil
+}
+
+// Uploads the local copy of the file to the proxy if it has pending changes
+// Must be called while holding file.mutex
+func (file *HgmFile) commit() error {
+	if file.stage == nil || file.dirty == false {
+		return nil
+	}
+
+	body := io.NewSectionReader(file.stage, 0, int64(file.fileSize))
+	req, err := http.NewRequest("PUT", file.hgmFs.proxyLink(file.path()), body)
+	if err != nil {
+		return fuse.EIO
+	}
+	req.ContentLength = int64(file.fileSize)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fuse.EIO
+	}
+	resp.Body.Close()
+
+	fuseErr := stattool.HttpStatusToFuseErr(resp.StatusCode)
+	if fuseErr == nil {
+		file.dirty = false
+		file.version++ // we replaced the content
+		invalidateStat(file.path())
+		rs := acquireReadSettings()
+		file.invalidateCache(rs.cache)
+		rs.release()
+	}
+	return fuseErr
+}
+
+func (fh *HgmFileHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
 	off := req.Offset
 
+	file := fh.file
+	file.mutex.Lock()
+	if file.stage != nil {
+		// file is being written: serve the data from our local copy
+		defer file.mutex.Unlock()
+		resp.Data = make([]byte, req.Size)
+		nr, err := file.stage.ReadAt(resp.Data, off)
+		resp.Data = resp.Data[:nr]
+		if err != nil && err != io.EOF {
+			return fuse.EIO
+		}
+		return nil
+	}
+	fileSize := file.fileSize // may be changed by Lookup while we are reading
+	version := file.version
+	file.mutex.Unlock()
+
 	// quickly abort on pseudo-empty files
-	if file.fileSize == 0 {
+	if fileSize == 0 {
 		return nil
 	}
 
-	if lruCache != nil {
-		// Request would bypass the LRU cache -> chop it
-		if req.Size > int(lruBlockSize) {
-			req.Size = int(lruBlockSize)
+	rs := acquireReadSettings()
+	defer rs.release()
+
+	fh.mutex.Lock()
+	defer fh.mutex.Unlock()
+	if fh.version != version {
+		// the file was replaced through this mount since we read from it
+		fh.resetHandle()
+		fh.etag = ""
+		fh.version = version
+	}
+
+	// Serve the request block by block: each one may be cached. The kernel treats
+	// a short read as EOF unless direct_io is enabled, so we must not return less
+	// than requested unless we hit the end of the file
+	resp.Data = make([]byte, 0, req.Size)
+	for len(resp.Data) < req.Size {
+		size := req.Size - len(resp.Data)
+		if rs.cache != nil && size > int(rs.blockSize) {
+			size = int(rs.blockSize)
+		}
+		data, err := fh.readAt(rs, req.Handle, off+int64(len(resp.Data)), size, fileSize)
+		resp.Data = append(resp.Data, data...)
+		if err != nil && len(resp.Data) == 0 {
+			return err
+		}
+		if err != nil || len(data) < size {
+			break // the error (if any) is returned by the next read
+		}
+	}
+	return nil
+}
+
+// Reads up to size bytes at offset off, from the LRU cache if possible.
+// Less than size bytes are only returned at the end of the file
+func (fh *HgmFileHandle) readAt(rs readSettings, rqid fuse.HandleID, off int64, size int, fileSize uint64) ([]byte, error) {
+	if rs.cache != nil {
+		if fh.etag == "" {
+			// cached blocks may belong to another version of this file
+			fh.fetchEtag(rs.cache)
 		}
 
-		cacheData, cacheOk := lruCache.Get(file.lruKey(off))
-		if cacheOk {
-			resp.Data = cacheData
-			if len(resp.Data) > req.Size {
+		cacheData, cacheOk := rs.cache.Get(fh.file.lruKey(off))
+		if cacheOk && fh.etag != "" {
+			if len(cacheData) > size {
 				// chop off if we got too much data
-				resp.Data = resp.Data[:req.Size]
+				cacheData = cacheData[:size]
 			}
-			hgmStats.bytesHit += int64(len(resp.Data))
-			return nil
+			hgmStats.bytesHit += int64(len(cacheData))
+			return cacheData, nil
 		}
 	}
 
 	// Our open HTTP connection is at the wrong offset.
 	// Do a quick-forward if we can or drop it if we seek backwards or to a far pos
-	if off != file.offset && file.connected == true {
-		mustSeek := off - file.offset
+	if off != fh.offset && fh.connected == true {
+		mustSeek := off - fh.offset
 		keepConn := false
 
-		if mustSeek > 0 && mustSeek < maxFwdBytes {
-			err := file.readBody(mustSeek, nil)
+		if mustSeek > 0 && mustSeek < rs.maxFwd {
+			err := fh.readBody(rs, mustSeek, nil)
 			if err == nil {
 				keepConn = true
-				fmt.Printf("<%08X> skipped %d bytes via fast-forward, now at: %d\n", rqid, mustSeek, file.offset)
+				fmt.Printf("<%08X> skipped %d bytes via fast-forward, now at: %d\n", rqid, mustSeek, fh.offset)
 			}
 		}
 
@@ -289,73 +802,94 @@ func (file *HgmFile) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse
 		// This may even happen if everything looked fine: The Go Net-GC might have
 		// killed the http connection
 		if keepConn == false {
-			file.resetHandle()
+			fh.resetHandle()
 			fmt.Printf("<%08X> connection was reset (mustSeek=%d)\n", rqid, mustSeek)
 		}
 	}
 
 	// No open http connection: Create a new request
-	if file.connected == false {
-		linkURL := &url.URL{Path: file.localFile}
-		linkName := linkURL.String()
-		fmt.Printf("<%08X> Establishing a new connection, need to seek to %d, fname=%s\n", rqid, off, linkName)
+	if fh.connected == false {
+		fmt.Printf("<%08X> Establishing a new connection, need to seek to %d, fname=%s\n", rqid, off, fh.file.path())
 
-		// skip first char in filename as this would be the fs root (/)
-		req, err := http.NewRequest("GET", fmt.Sprintf("%s%s", file.hgmFs.proxyUrl, linkName[1:]), nil)
+		req, err := http.NewRequest("GET", fh.file.hgmFs.proxyLink(fh.file.path()), nil)
 		if err != nil {
-			return fuse.EIO
+			return nil, fuse.EIO
 		}
 
 		req.Header.Add("Range", fmt.Sprintf("bytes=%d-", off))
+		if fh.etag != "" {
+			// we already returned data of this file: make sure it did not change in between
+			req.Header.Add("If-Match", fh.etag)
+		}
 		resp, err := httpClient.Do(req)
 		if err != nil {
-			return fuse.EIO
+			return nil, fuse.EIO
 		}
 
 		// got our connection: set it up
-		file.offset = off
-		file.resp = resp
-		file.connected = true
-		file.bbody = bufio.NewReaderSize(file.resp.Body, 1024*512)
-
-		if resp.StatusCode != 200 && resp.StatusCode != 206 {
-			fmt.Printf("<%08X> FATAL: Wrong status code: %d (file=%s)\n", rqid, resp.StatusCode, file.localFile)
-			file.resetHandle()
-			return fuse.EIO
+		fh.offset = off
+		fh.resp = resp
+		fh.connected = true
+		fh.bbody = bufio.NewReaderSize(fh.resp.Body, 1024*512)
+
+		if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			// we are at (or beyond) the end of the file
+			fh.resetHandle()
+			return nil, nil
+		} else if resp.StatusCode == http.StatusPreconditionFailed {
+			fmt.Printf("<%08X> file changed while reading (file=%s)\n", rqid, fh.file.path())
+			fh.resetHandle()
+			fh.etag = ""
+			fh.file.invalidateCache(rs.cache)
+			return nil, stattool.HttpStatusToFuseErr(resp.StatusCode)
+		} else if resp.StatusCode != 200 && resp.StatusCode != 206 {
+			fmt.Printf("<%08X> FATAL: Wrong status code: %d (file=%s)\n", rqid, resp.StatusCode, fh.file.path())
+			fh.resetHandle()
+			return nil, fuse.EIO
 		} else if resp.StatusCode == 200 && off != 0 {
 			fmt.Printf("<%08x> Server was unable to fulfill request for offset %d -> reading up to destination\n", rqid, off)
-			file.offset = 0 // we are at the beginning
-			err = file.readBody(off, nil)
+			fh.offset = 0 // we are at the beginning
+			err = fh.readBody(rs, off, nil)
 			if err != nil {
-				file.resetHandle()
-				return fuse.EIO
+				fh.resetHandle()
+				return nil, fuse.EIO
+			}
+		}
+
+		if fh.etag == "" {
+			// first response since open(): the file may have changed since we saw it for the last time
+			fh.etag = resp.Header.Get("ETag")
+			fh.checkCachedVersion(rs.cache)
+			if size, ok := responseFileSize(resp); ok {
+				fileSize = size
+				fh.file.setFileSize(size)
 			}
 		}
 	}
 
-	resp.Data = make([]byte, 0, req.Size)
-	err := file.readBody(int64(req.Size), &resp.Data)
+	data := make([]byte, 0, size)
+	err := fh.readBody(rs, int64(size), &data)
 
-	if err == io.EOF && file.fileSize == uint64(len(resp.Data))+uint64(off) {
+	if err == io.EOF && fileSize == uint64(len(data))+uint64(off) {
 		// We hit the end of the file: There is no need to claim
 		// that there was an error
 		err = nil
 	}
 
-	return err
+	return data, err
 }
 
-// Discards count bytes from the filehandle connected
-// to the HgmFile descriptor
+// Discards count bytes from the HTTP connection
 // Will put a copy of the read data into copySink if non nil
+// (and into the LRU cache of rs)
 // The code will not expand/make copySink!
-func (file *HgmFile) readBody(count int64, copySink *[]byte) (err error) {
+func (fh *HgmFileHandle) readBody(rs readSettings, count int64, copySink *[]byte) (err error) {
 
 	for count != 0 {
 		// Creates a sink which we are going to use as our read buffer
 		// note that this is re-allocated on each loop as we may pass
 		// this reference to lruCache and must avoid overwriting it afterwards
-		byteSink := make([]byte, lruBlockSize)
+		byteSink := make([]byte, rs.blockSize)
 		if int64(len(byteSink)) > count {
 			// shrink buffer size if we got less to read than allocated
 			byteSink = byteSink[:count]
@@ -363,7 +897,7 @@ func (file *HgmFile) readBody(count int64, copySink *[]byte) (err error) {
 
 		nr := 0
 		for nr != len(byteSink) {
-			rb, re := file.bbody.Read(byteSink[nr:])
+			rb, re := fh.bbody.Read(byteSink[nr:])
 			nr += rb
 
 			if re != nil {
@@ -378,10 +912,10 @@ func (file *HgmFile) readBody(count int64, copySink *[]byte) (err error) {
 
 		if copySink != nil {
 			*copySink = append(*copySink, byteSink[:nr]...)
-			if lruCache != nil && ((nr > 0 && err == nil) || (nr == 0 && err == io.EOF)) {
+			if rs.cache != nil && ((nr > 0 && err == nil) || (nr == 0 && err == io.EOF)) {
 				// Cache whatever we got from a lruBlockSize boundary
 				// this will always be <= lruBlockSize
-				evicted := lruCache.Add(file.lruKey(file.offset), byteSink[:nr])
+				evicted := rs.cache.Add(fh.file.lruKey(fh.offset), byteSink[:nr])
 				if evicted {
 					hgmStats.lruEvicted++
 				}
@@ -389,7 +923,7 @@ func (file *HgmFile) readBody(count int64, copySink *[]byte) (err error) {
 			}
 		}
 
-		file.offset += int64(nr)
+		fh.offset += int64(nr)
 		count -= int64(nr)
 
 		if err != nil {
@@ -401,16 +935,80 @@ func (file *HgmFile) readBody(count int64, copySink *[]byte) (err error) {
 }
 
 // Returns the cache key used for our in-memory LRU cache
-func (file HgmFile) lruKey(offset int64) string {
-	return fmt.Sprintf("%d/%s", offset, file.localFile)
+func (file *HgmFile) lruKey(offset int64) string {
+	return fmt.Sprintf("%s%d", file.lruPrefix(), offset)
+}
+
+// Returns the prefix shared by all cache keys of this file
+func (file *HgmFile) lruPrefix() string {
+	return file.path() + "\x00"
+}
+
+// Learns the ETag (and size) of the current version of the file
+func (fh *HgmFileHandle) fetchEtag(cache *lruHandle) {
+	resp, err := httpClient.Head(fh.file.hgmFs.proxyLink(fh.file.path()))
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		fh.etag = resp.Header.Get("ETag")
+		if size, ok := responseFileSize(resp); ok {
+			fh.file.setFileSize(size)
+		}
+		fh.checkCachedVersion(cache)
+	}
+}
+
+// Updates the size of the file as reported by the proxy
+func (file *HgmFile) setFileSize(size uint64) {
+	file.mutex.Lock()
+	file.fileSize = size
+	file.mutex.Unlock()
+}
+
+// Drops the cached blocks of this file if they belong to another version of it:
+// the ETag of the cached content is stored next to the blocks
+func (fh *HgmFileHandle) checkCachedVersion(cache *lruHandle) {
+	if cache == nil || fh.etag == "" {
+		return
+	}
+	etagKey := fh.file.lruPrefix() + "etag"
+	if cachedEtag, ok := cache.Get(etagKey); ok == false || string(cachedEtag) != fh.etag {
+		fh.file.invalidateCache(cache)
+		cache.Replace(etagKey, []byte(fh.etag))
+	}
+}
+
+// Drops all blocks of this file from the given LRU cache (if any)
+func (file *HgmFile) invalidateCache(cache *lruHandle) {
+	if cache != nil {
+		if n := cache.InvalidatePrefix(file.lruPrefix()); n > 0 {
+			fmt.Printf("dropped %d cached blocks of %s\n", n, file.path())
+		}
+	}
+}
+
+// Returns the size of the whole file served by resp
+func responseFileSize(resp *http.Response) (uint64, bool) {
+	if resp.StatusCode == http.StatusOK && resp.ContentLength >= 0 {
+		return uint64(resp.ContentLength), true
+	}
+	contentRange := resp.Header.Get("Content-Range") // bytes first-last/size
+	if i := strings.LastIndex(contentRange, "/"); i >= 0 {
+		size, err := strconv.ParseUint(contentRange[i+1:], 10, 64)
+		return size, err == nil
+	}
+	return 0, false
 }
 
-func (file *HgmFile) resetHandle() {
-	if file.resp != nil {
-		file.resp.Body.Close()
-		file.resp = nil
+func (fh *HgmFileHandle) resetHandle() {
+	if fh.resp != nil {
+		fh.resp.Body.Close()
+		fh.resp = nil
 	}
-	file.bbody = nil
-	file.connected = false
-	file.offset = 0
+	fh.bbody = nil
+	fh.connected = false
+	fh.offset = 0
 }
@@ -0,0 +1,75 @@
+package hgmfs
+
+import (
+	"bazil.org/fuse/fs"
+	"strings"
+	"sync"
+)
+
+// A directory or file node which knows its own path
+type hgmNode interface {
+	fs.Node
+	setPath(path string) // must be called while holding nodeRegistry's write lock
+}
+
+// Nodes handed out to the kernel, indexed by their path (directories end with a slash).
+// The kernel keeps using a node after it was renamed, so renames must update the
+// path of all affected nodes. The lock also protects the path of each node
+var nodeRegistry = struct {
+	sync.RWMutex
+	nodes map[string]hgmNode
+}{nodes: make(map[string]hgmNode)}
+
+// Returns the node registered for path. The given node is registered if
+// there is none yet or if replace is true
+func registerNode(path string, node hgmNode, replace bool) hgmNode {
+	nodeRegistry.Lock()
+	defer nodeRegistry.Unlock()
+
+	if existing, ok := nodeRegistry.nodes[path]; ok && replace == false {
+		return existing
+	}
+	nodeRegistry.nodes[path] = node
+	return node
+}
+
+// Drops node from the registry, called if the kernel forgets about it
+func forgetNode(path string, node hgmNode) {
+	nodeRegistry.Lock()
+	defer nodeRegistry.Unlock()
+
+	if nodeRegistry.nodes[path] == node {
+		delete(nodeRegistry.nodes, path)
+	}
+}
+
+// Drops the node of a removed file or (empty) directory
+func removeNode(path string) {
+	nodeRegistry.Lock()
+	defer nodeRegistry.Unlock()
+
+	delete(nodeRegistry.nodes, path)
+	delete(nodeRegistry.nodes, path+"/")
+}
+
+// Updates all nodes at or below oldPath after a rename to newPath
+func moveNodes(oldPath string, newPath string) {
+	nodeRegistry.Lock()
+	defer nodeRegistry.Unlock()
+
+	moved := make(map[string]hgmNode)
+	for path, node := range nodeRegistry.nodes {
+		if path == oldPath || strings.HasPrefix(path, oldPath+"/") {
+			moved[newPath+path[len(oldPath):]] = node
+			delete(nodeRegistry.nodes, path)
+		} else if path == newPath || strings.HasPrefix(path, newPath+"/") {
+			// replaced by the rename
+			delete(nodeRegistry.nodes, path)
+		}
+	}
+
+	for path, node := range moved {
+		node.setPath(path)
+		nodeRegistry.nodes[path] = node
+	}
+}
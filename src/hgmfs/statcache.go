@@ -0,0 +1,151 @@
+package hgmfs
+
+import (
+	"bazil.org/fuse"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxStatCacheEntries = 65536 // expired entries are dropped once a cache grows beyond this
+
+// Attributes and directory listings returned by the stat service, indexed by
+// their path (without a trailing slash). Failed lookups are cached as well
+var statCache = struct {
+	sync.Mutex
+	attrs map[string]cachedAttr
+	dirs  map[string]cachedDir
+}{attrs: make(map[string]cachedAttr), dirs: make(map[string]cachedDir)}
+
+type cachedAttr struct {
+	attr    fuse.Attr
+	err     error // fuse.ENOENT for negative entries
+	expires time.Time
+}
+
+type cachedDir struct {
+	dirents []fuse.Dirent
+	expires time.Time
+}
+
+// Returns the cached attributes of path, ok is false if there are none.
+// The validity of the returned attributes is set to their remaining lifetime
+func cachedStat(path string) (attr fuse.Attr, err error, ok bool) {
+	statCache.Lock()
+	defer statCache.Unlock()
+
+	entry, ok := statCache.attrs[statKey(path)]
+	now := time.Now()
+	if ok == false || now.After(entry.expires) {
+		return attr, nil, false
+	}
+	attr = entry.attr
+	attr.Valid = entry.expires.Sub(now)
+	return attr, entry.err, true
+}
+
+// Caches the result of a stat call, only successful and negative lookups are kept
+// The validity of attr is set to the time it will be cached
+func storeStat(path string, attr *fuse.Attr, err error) {
+	settingsLock.RLock()
+	ttl := attrTTL
+	if err == fuse.ENOENT {
+		ttl = negativeTTL
+	} else if err != nil {
+		ttl = 0
+	}
+	settingsLock.RUnlock()
+	attr.Valid = ttl
+	if ttl <= 0 {
+		return
+	}
+
+	statCache.Lock()
+	defer statCache.Unlock()
+	if len(statCache.attrs) >= maxStatCacheEntries {
+		pruneStatCache()
+	}
+	statCache.attrs[statKey(path)] = cachedAttr{attr: *attr, err: err, expires: time.Now().Add(ttl)}
+}
+
+// Returns the cached listing of the directory at path
+func cachedDirents(path string) ([]fuse.Dirent, bool) {
+	statCache.Lock()
+	defer statCache.Unlock()
+
+	entry, ok := statCache.dirs[statKey(path)]
+	if ok == false || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.dirents, true
+}
+
+// Caches the listing of the directory at path
+func storeDirents(path string, dirents []fuse.Dirent) {
+	settingsLock.RLock()
+	ttl := dirTTL
+	settingsLock.RUnlock()
+	if ttl <= 0 {
+		return
+	}
+
+	statCache.Lock()
+	defer statCache.Unlock()
+	if len(statCache.dirs) >= maxStatCacheEntries {
+		pruneStatCache()
+	}
+	statCache.dirs[statKey(path)] = cachedDir{dirents: dirents, expires: time.Now().Add(ttl)}
+}
+
+// Drops everything we know about path, its children and its parent directory:
+// called after we modified path
+func invalidateStat(path string) {
+	key := statKey(path)
+	parent := key[:strings.LastIndex(key, "/")+1]
+
+	statCache.Lock()
+	defer statCache.Unlock()
+	for k := range statCache.attrs {
+		if k == key || strings.HasPrefix(k, key+"/") {
+			delete(statCache.attrs, k)
+		}
+	}
+	for k := range statCache.dirs {
+		if k == key || strings.HasPrefix(k, key+"/") {
+			delete(statCache.dirs, k)
+		}
+	}
+	delete(statCache.attrs, statKey(parent))
+	delete(statCache.dirs, statKey(parent))
+}
+
+// Drops all expired entries, or everything if there are none
+// Must be called while holding statCache's lock
+func pruneStatCache() {
+	now := time.Now()
+	for k, v := range statCache.attrs {
+		if now.After(v.expires) {
+			delete(statCache.attrs, k)
+		}
+	}
+	for k, v := range statCache.dirs {
+		if now.After(v.expires) {
+			delete(statCache.dirs, k)
+		}
+	}
+	if len(statCache.attrs) >= maxStatCacheEntries {
+		statCache.attrs = make(map[string]cachedAttr)
+	}
+	if len(statCache.dirs) >= maxStatCacheEntries {
+		statCache.dirs = make(map[string]cachedDir)
+	}
+}
+
+// Returns the cache key of path: directories are ending with a slash, but a
+// lookup of the same directory does not
+func statKey(path string) string {
+	if len(path) > 1 {
+		return strings.TrimSuffix(path, "/")
+	}
+	return path
+}
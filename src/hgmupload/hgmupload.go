@@ -0,0 +1,150 @@
+/*
+ * Copyright (C) 2015 Adrian Ulrich <adrian@blinkenlights.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package hgmupload
+
+import (
+	"bufio"
+	"fmt"
+	"libhgms/backend"
+	"libhgms/uploadtool"
+	"log"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+)
+
+var metaDir = "./_aliases/"
+var minFileSize = int64(4096) // smaller files are skipped
+
+type uploadOptions struct {
+	replicate bool
+	dryRun    bool
+	target    string
+	layout    string
+	upTool    *uploadtool.UploadTool
+}
+
+/**
+ * Uploads all given files to target (see backend.ForTarget), called by hgmcmd
+ * Paths are read from stdin if the list is empty
+ */
+func UploadFiles(paths []string, target string, layout string, replicate bool, dryRun bool) {
+	opts := &uploadOptions{replicate: replicate, dryRun: dryRun, target: target, layout: layout}
+
+	// Sending HUP to us will quit the process
+	// after the current file has been uploaded
+	terminate := int32(0)
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+	go func() {
+		for range sigChan {
+			atomic.StoreInt32(&terminate, 1)
+			fmt.Fprintf(os.Stderr, "\n%s: SIGHUP received, will terminate after current upload completed...\n", os.Args[0])
+		}
+	}()
+
+	var scanner *bufio.Scanner
+	if len(paths) == 0 {
+		scanner = bufio.NewScanner(os.Stdin)
+	}
+
+	for {
+		sourceFile := ""
+		if scanner != nil {
+			if scanner.Scan() == false {
+				break
+			}
+			sourceFile = scanner.Text()
+		} else {
+			if len(paths) == 0 {
+				break
+			}
+			sourceFile = paths[0]
+			paths = paths[1:]
+		}
+
+		err := opts.uploadFile(sourceFile)
+		if err != nil {
+			log.Fatalf("failed to upload '%s': %s\n", sourceFile, err)
+		}
+
+		if atomic.LoadInt32(&terminate) != 0 {
+			fmt.Printf("# Exiting due to SIGHUP\n")
+			break
+		}
+	}
+}
+
+// Encrypts and uploads a single file and records its location in metaDir
+func (opts *uploadOptions) uploadFile(sourceFile string) error {
+	fi, err := os.Stat(sourceFile)
+	if err != nil || fi.Mode().IsRegular() == false || fi.Size() < minFileSize {
+		fmt.Printf("skipping '%s'\n", sourceFile)
+		return nil
+	}
+
+	metaOut := metaDir + sourceFile
+	fmt.Printf("file=%s, meta=%s (%d bytes)...\n   ", sourceFile, metaOut, fi.Size())
+
+	meta, err := uploadtool.ReadMeta(metaOut)
+	if err == nil && len(meta.Key) > 0 {
+		if opts.replicate == false {
+			fmt.Printf("# skipping existing file: %s\n", metaOut)
+			return nil
+		}
+		if uint64(fi.Size()) != meta.ContentSize {
+			// a replica of another content would be corrupted
+			return fmt.Errorf("file has %d bytes, but %d bytes were uploaded", fi.Size(), meta.ContentSize)
+		}
+		fmt.Printf("# metadata exists, adding new copy with same encryption key and blobsize (%d)\n", meta.BlobSize)
+	} else if opts.dryRun == true {
+		fmt.Printf("# ignoring '%s' in dry-run mode\n", metaOut)
+		return nil
+	} else {
+		// no existing info: create a prototype
+		meta, err = uploadtool.NewMeta(fi.Size())
+		if err != nil {
+			return err
+		}
+		fmt.Printf("# creating new metadata at %s (blobsize=%.2fMB)\n", metaOut, float64(meta.BlobSize)/1024/1024)
+	}
+
+	if opts.upTool == nil {
+		be, err := backend.ForTarget(opts.target)
+		if err != nil {
+			return err
+		}
+		opts.upTool = uploadtool.New(be)
+		opts.upTool.MaxRetries = -1
+		opts.upTool.Layout = opts.layout
+	}
+
+	fh, err := os.Open(sourceFile)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	err = opts.upTool.AddReplica(meta, fh)
+	if err != nil {
+		return err
+	}
+
+	return uploadtool.WriteMeta(metaOut, meta)
+}
@@ -0,0 +1,146 @@
+/*
+ * Copyright (C) 2015 Adrian Ulrich <adrian@blinkenlights.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package hgmverify
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"libhgms/backend"
+	"libhgms/flickr/png"
+	"libhgms/stattool"
+	"libhgms/uploadtool"
+	"os"
+	"path/filepath"
+)
+
+/**
+ * Downloads and decrypts all replicas of the given alias files (or directories)
+ * and compares their content with the digests stored in the metadata, called by hgmcmd
+ * Returns false if any replica failed to verify
+ */
+func VerifyFiles(paths []string, localRoot string) bool {
+	if len(localRoot) > 0 {
+		if err := backend.AllowLocalRoot(localRoot); err != nil {
+			fmt.Printf("%s: %s\n", localRoot, err)
+			return false
+		}
+	}
+
+	allOk := true
+	for _, root := range paths {
+		err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if fi.Mode().IsRegular() == true && verifyFile(path) == false {
+				allOk = false
+			}
+			return nil
+		})
+		if err != nil {
+			fmt.Printf("%s: %s\n", root, err)
+			allOk = false
+		}
+	}
+	return allOk
+}
+
+// Verifies all replicas of a single alias file
+func verifyFile(path string) bool {
+	meta, err := uploadtool.ReadMeta(path)
+	if err != nil {
+		fmt.Printf("%s: failed to read metadata: %s\n", path, err)
+		return false
+	}
+
+	key, err := hex.DecodeString(meta.Key)
+	if err != nil {
+		fmt.Printf("%s: invalid key in metadata\n", path)
+		return false
+	}
+
+	if meta.ContentSha256 == "" {
+		fmt.Printf("%s: no digest recorded, only checking if replicas can be decoded\n", path)
+	}
+
+	if len(meta.Location) == 0 {
+		fmt.Printf("%s: no replicas listed\n", path)
+		return false
+	}
+
+	allOk := true
+	for ri, replica := range meta.Location {
+		digest, err := verifyReplica(meta, replica, key)
+		if err == nil && meta.ContentSha256 != "" && digest != meta.ContentSha256 {
+			err = uploadtool.ErrContentChanged
+		}
+
+		if err != nil {
+			fmt.Printf("%s: replica %d FAILED: %s\n", path, ri, err)
+			allOk = false
+		} else {
+			fmt.Printf("%s: replica %d ok, sha256=%s\n", path, ri, digest)
+		}
+	}
+	return allOk
+}
+
+// Decrypts all parts of replica, returns the hex encoded digest of its content
+func verifyReplica(meta *stattool.JsonMeta, replica []string, key []byte) (string, error) {
+	if len(meta.PartSha256) > 0 && len(meta.PartSha256) != len(replica) {
+		return "", fmt.Errorf("replica has %d parts, expected %d", len(replica), len(meta.PartSha256))
+	}
+
+	contentHash := sha256.New()
+	size := uint64(0)
+	for pi, location := range replica {
+		partHash := sha256.New()
+		n, err := fetchPart(location, io.MultiWriter(contentHash, partHash), meta.Version, key, pi, int64(meta.ContentSize))
+		if err != nil {
+			return "", fmt.Errorf("part %d (%s): %s", pi, location, err)
+		}
+		size += uint64(n)
+
+		if len(meta.PartSha256) > 0 && hex.EncodeToString(partHash.Sum(nil)) != meta.PartSha256[pi] {
+			return "", fmt.Errorf("part %d (%s): digest mismatch", pi, location)
+		}
+	}
+
+	if size != meta.ContentSize {
+		return "", fmt.Errorf("content has %d bytes, expected %d", size, meta.ContentSize)
+	}
+	return hex.EncodeToString(contentHash.Sum(nil)), nil
+}
+
+// Downloads and decrypts the blob at location into dst, this is part blobIndex of a file with contentSize bytes
+func fetchPart(location string, dst io.Writer, version int, key []byte, blobIndex int, contentSize int64) (int64, error) {
+	be, err := backend.ForLocation(location)
+	if err != nil {
+		return 0, err
+	}
+
+	blobReader, err := be.Get(location, 0, -1)
+	if err != nil {
+		return 0, err
+	}
+	defer blobReader.Close()
+
+	return flickr.DecodeBlob(dst, blobReader, version, key, blobIndex, contentSize)
+}
@@ -0,0 +1,295 @@
+/*
+ * Copyright (C) 2015 Adrian Ulrich <adrian@blinkenlights.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package hgmweb
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"libhgms/ssc"
+	"net/http"
+	"sync"
+)
+
+const cacheChunkSize = 64 * 1024 // decrypted content is cached in pieces of this size
+
+/* On-disk cache of decrypted blob content, nil if disabled */
+var blobCache *ssc.Cache
+
+const maxWarmups = 2 // warm-ups running at once, further ones wait for a free slot
+
+/* Warm-ups running in the background, a file is only warmed up once at a time */
+var warmups = struct {
+	sync.Mutex
+	active map[string]bool // content keys of all queued or running warm-ups
+	slots  chan bool       // holds a value for each running warm-up
+	cancel chan bool       // closed once the blob cache gets closed
+	wg     sync.WaitGroup  // tracks all queued or running warm-ups
+}{active: make(map[string]bool), slots: make(chan bool, maxWarmups)}
+
+var errWarmupCancelled = errors.New("warm-up cancelled")
+
+/**
+ * Opens (or creates) the blob cache at path, using at most sizeMB megabytes
+ * If syncWrites is set, each change is flushed to disk before it is used
+ */
+func openBlobCache(path string, sizeMB int, syncWrites bool) error {
+	chunkCount := uint32(int64(sizeMB) * 1024 * 1024 / cacheChunkSize)
+	if chunkCount == 0 {
+		return fmt.Errorf("cache size of %dMB is too small", sizeMB)
+	}
+	cache, err := ssc.New(path, cacheChunkSize, chunkCount)
+	if err != nil {
+		return err
+	}
+	if syncWrites {
+		cache.Sync = ssc.SYNC_WRITES
+	}
+	blobCache = cache
+
+	warmups.Lock()
+	warmups.cancel = make(chan bool)
+	warmups.Unlock()
+	return nil
+}
+
+/**
+ * Closes the blob cache (if any), marking its database as cleanly closed
+ * Warm-ups are cancelled first: they must not write to a closed cache
+ */
+func closeBlobCache() {
+	warmups.Lock()
+	if warmups.cancel != nil {
+		close(warmups.cancel)
+		warmups.cancel = nil
+	}
+	warmups.Unlock()
+	warmups.wg.Wait()
+
+	if blobCache != nil {
+		blobCache.Close()
+		blobCache = nil
+	}
+}
+
+/**
+ * Returns the cache key of the chunk at offset of the given blob: the key
+ * of the content is unique for each upload, so it also identifies its blobs.
+ * Only a digest of it is used, the cache must not hold the key to its content
+ */
+func cacheKey(rqm rqMeta, blob int64, offset int64) string {
+	digest := sha256.Sum256([]byte(rqm.Key))
+	return fmt.Sprintf("%s/%d/%d", hex.EncodeToString(digest[:])[:32], blob, offset)
+}
+
+/**
+ * Returns the amount of content stored in the given blob
+ */
+func blobLength(rqm rqMeta, blob int64) int64 {
+	n := rqm.ContentSize - blob*rqm.BlobSize
+	if n > rqm.BlobSize {
+		n = rqm.BlobSize
+	}
+	return n
+}
+
+/**
+ * Writes seg to w: cached chunks are served from the blob cache, everything
+ * else is fetched via streamBlob and added to the cache
+ */
+func serveSegment(w io.Writer, rqm rqMeta, key []byte, seg blobSegment) error {
+	if blobCache == nil || seg.blob >= int64(len(rqm.Location[0])) {
+		return streamBlob(&rangeWriter{w: w, remain: seg.length}, rqm, key, seg)
+	}
+
+	blobLen := blobLength(rqm, seg.blob)
+	for seg.length > 0 {
+		chunkStart := seg.skip - seg.skip%cacheChunkSize
+		chunkLen := blobLen - chunkStart
+		if chunkLen > cacheChunkSize {
+			chunkLen = cacheChunkSize
+		}
+		data, ok := blobCache.Get(cacheKey(rqm, seg.blob, chunkStart))
+		if ok == false || int64(len(data)) != chunkLen {
+			break
+		}
+		data = data[seg.skip-chunkStart:]
+		if int64(len(data)) > seg.length {
+			data = data[:seg.length]
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		seg.skip += int64(len(data))
+		seg.length -= int64(len(data))
+	}
+
+	if seg.length == 0 {
+		return nil
+	}
+	fmt.Printf("  >> cache miss at blob %d, offset %d\n", seg.blob, seg.skip)
+
+	// fetch whole chunks, so that all of them can be cached
+	fetch := blobSegment{blob: seg.blob, skip: seg.skip - seg.skip%cacheChunkSize}
+	fetchEnd := seg.skip + seg.length
+	if partial := fetchEnd % cacheChunkSize; partial != 0 {
+		fetchEnd += cacheChunkSize - partial
+	}
+	if fetchEnd > blobLen {
+		fetchEnd = blobLen
+	}
+	fetch.length = fetchEnd - fetch.skip
+
+	cw := &cacheWriter{w: w, rqm: rqm, blob: seg.blob, offset: fetch.skip, blobLen: blobLen, head: seg.skip - fetch.skip, remain: seg.length}
+	return streamBlob(&rangeWriter{w: cw, remain: fetch.length}, rqm, key, fetch)
+}
+
+/* Adds decrypted blob content to the blob cache and passes the requested part of it to w */
+type cacheWriter struct {
+	w       io.Writer
+	rqm     rqMeta
+	blob    int64
+	offset  int64  /* position of the next byte within the blob, starts at a chunk boundary */
+	blobLen int64  /* size of the blob content */
+	head    int64  /* bytes to hold back from w before sending anything */
+	remain  int64  /* bytes to send to w */
+	buf     []byte /* the current chunk */
+}
+
+func (cw *cacheWriter) Write(p []byte) (int, error) {
+	out := p
+	if cw.head > 0 {
+		n := cw.head
+		if n > int64(len(out)) {
+			n = int64(len(out))
+		}
+		out = out[n:]
+		cw.head -= n
+	}
+	if int64(len(out)) > cw.remain {
+		out = out[:cw.remain]
+	}
+	if len(out) > 0 {
+		n, err := cw.w.Write(out)
+		cw.remain -= int64(n)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	for data := p; len(data) > 0; {
+		if cw.buf == nil {
+			cw.buf = make([]byte, 0, cacheChunkSize)
+		}
+		take := cacheChunkSize - int64(len(cw.buf))
+		if take > int64(len(data)) {
+			take = int64(len(data))
+		}
+		cw.buf = append(cw.buf, data[:take]...)
+		cw.offset += take
+		data = data[take:]
+
+		if len(cw.buf) == cacheChunkSize || cw.offset == cw.blobLen {
+			blobCache.Add(cacheKey(cw.rqm, cw.blob, cw.offset-int64(len(cw.buf))), cw.buf)
+			cw.buf = nil
+		}
+	}
+	return len(p), nil
+}
+
+/**
+ * Warm-up endpoint: fetches the requested file into the blob cache in the background
+ */
+func handleWarmup(w http.ResponseWriter, r *http.Request) {
+	unEscapedRqUri := r.URL.Path
+	unEscapedRqUri = unEscapedRqUri[len(proxyConfig.Warmup)+len(proxyConfig.Webroot):]
+
+	if blobCache == nil {
+		w.WriteHeader(http.StatusNotImplemented)
+		io.WriteString(w, "The blob cache is disabled\n")
+		return
+	}
+
+	content, err := ioutil.ReadFile(fmt.Sprintf("./_aliases/%s", unEscapedRqUri))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, "File not found\n")
+		return
+	}
+
+	var js rqMeta
+	err = json.Unmarshal(content, &js)
+	if err != nil || len(js.Location) == 0 {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, "Corrupted metadata")
+		return
+	}
+
+	warmups.Lock()
+	if warmups.active[js.Key] == false && warmups.cancel != nil {
+		warmups.active[js.Key] = true
+		warmups.wg.Add(1)
+		go runWarmup(js, unEscapedRqUri, warmups.cancel)
+	}
+	warmups.Unlock()
+
+	w.WriteHeader(http.StatusAccepted)
+	io.WriteString(w, "Warming up\n")
+}
+
+/**
+ * Fetches the content of js into the blob cache once a warm-up slot is free,
+ * gives up once cancel gets closed
+ */
+func runWarmup(js rqMeta, name string, cancel chan bool) {
+	defer warmups.wg.Done()
+	defer func() {
+		warmups.Lock()
+		delete(warmups.active, js.Key)
+		warmups.Unlock()
+	}()
+
+	select {
+	case warmups.slots <- true:
+		defer func() { <-warmups.slots }()
+	case <-cancel:
+		fmt.Printf("warmup of %s cancelled\n", name)
+		return
+	}
+
+	key := make([]byte, len(js.Key)/2)
+	hex.Decode(key, []byte(js.Key))
+	err := streamContent(warmupSink(cancel), js, key, 0, js.ContentSize)
+	fmt.Printf("warmup of %s finished, error=%v\n", name, err)
+}
+
+/* Discards the content of a warm-up, fails once the warm-up is cancelled */
+type warmupSink chan bool
+
+func (ws warmupSink) Write(p []byte) (int, error) {
+	select {
+	case <-ws:
+		return 0, errWarmupCancelled
+	default:
+		return len(p), nil
+	}
+}
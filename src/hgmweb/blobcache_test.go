@@ -0,0 +1,137 @@
+/*
+ * Copyright (C) 2015 Adrian Ulrich <adrian@blinkenlights.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package hgmweb
+
+import (
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Waits until no warm-up is queued or running
+func waitForWarmups(t *testing.T) {
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		warmups.Lock()
+		n := len(warmups.active)
+		warmups.Unlock()
+		if n == 0 {
+			return
+		}
+	}
+	t.Fatalf("warm-ups did not finish")
+}
+
+func TestWarmupOncePerFile(t *testing.T) {
+	content := make([]byte, 200000)
+	rand.New(rand.NewSource(1)).Read(content)
+	dir := setupLocalProxy(t, "file.bin", content)
+	defer os.RemoveAll(dir)
+	proxyConfig.Warmup = ".warmup/"
+
+	if err := openBlobCache(filepath.Join(dir, "cache.db"), 1, false); err != nil {
+		t.Fatal(err)
+	}
+	defer closeBlobCache()
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+
+	// Occupy all slots: warm-ups stay queued until we release them
+	for i := 0; i < maxWarmups; i++ {
+		warmups.slots <- true
+	}
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		handleWarmup(w, httptest.NewRequest("GET", "/.warmup/file.bin", nil))
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("warm-up returned %d", w.Code)
+		}
+	}
+	warmups.Lock()
+	queued := len(warmups.active)
+	warmups.Unlock()
+	if queued != 1 {
+		t.Fatalf("%d warm-ups queued for a single file", queued)
+	}
+	for i := 0; i < maxWarmups; i++ {
+		<-warmups.slots
+	}
+
+	waitForWarmups(t)
+	if st := blobCache.Stats(); st.UsedBytes != uint64(len(content)) {
+		t.Fatalf("blob cache holds %d bytes, expected %d", st.UsedBytes, len(content))
+	}
+}
+
+func TestWarmupCancelledOnClose(t *testing.T) {
+	dir := setupLocalProxy(t, "file.bin", []byte("some content"))
+	defer os.RemoveAll(dir)
+	proxyConfig.Warmup = ".warmup/"
+
+	if err := openBlobCache(filepath.Join(dir, "cache.db"), 1, false); err != nil {
+		t.Fatal(err)
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+
+	// The warm-up stays queued as all slots are taken
+	for i := 0; i < maxWarmups; i++ {
+		warmups.slots <- true
+	}
+	defer func() {
+		for i := 0; i < maxWarmups; i++ {
+			<-warmups.slots
+		}
+	}()
+	handleWarmup(httptest.NewRecorder(), httptest.NewRequest("GET", "/.warmup/file.bin", nil))
+
+	closed := make(chan bool)
+	go func() {
+		closeBlobCache()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("closing the blob cache did not cancel the warm-up")
+	}
+
+	warmups.Lock()
+	active := len(warmups.active)
+	warmups.Unlock()
+	if active != 0 || blobCache != nil {
+		t.Fatalf("%d warm-ups left after closing the blob cache", active)
+	}
+}
@@ -0,0 +1,127 @@
+/*
+ * Copyright (C) 2015 Adrian Ulrich <adrian@blinkenlights.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package hgmweb
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+/**
+ * Returns a strong entity tag for the file described by rqm
+ * The tag changes whenever the file is re-uploaded or replicated
+ */
+func metaETag(rqm rqMeta) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%d\n%d\n%d\n", rqm.Key, rqm.ContentSize, rqm.BlobSize, rqm.Version)
+	for _, replica := range rqm.Location {
+		fmt.Fprintf(h, "%s\n", strings.Join(replica, "\n"))
+	}
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+/**
+ * Evaluates the conditional headers of r as described in RFC 7232, section 6
+ * Returns the status to reply with or 0 if the request shall be served
+ */
+func checkPreconditions(r *http.Request, etag string, lastModified time.Time) int {
+	isRead := r.Method == "GET" || r.Method == "HEAD"
+
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		if etagListMatches(ifMatch, etag, false) == false {
+			return http.StatusPreconditionFailed
+		}
+	} else if ius, err := http.ParseTime(r.Header.Get("If-Unmodified-Since")); err == nil {
+		if lastModified.Unix() > ius.Unix() {
+			return http.StatusPreconditionFailed
+		}
+	}
+
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		if etagListMatches(ifNoneMatch, etag, true) {
+			if isRead {
+				return http.StatusNotModified
+			}
+			return http.StatusPreconditionFailed
+		}
+	} else if ims, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && isRead {
+		if lastModified.Unix() <= ims.Unix() {
+			return http.StatusNotModified
+		}
+	}
+
+	return 0
+}
+
+/**
+ * Returns true if the comma separated list of entity tags contains etag (or is '*')
+ * Weak tags only match if weak comparison was requested
+ */
+func etagListMatches(list string, etag string, weak bool) bool {
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if strings.HasPrefix(candidate, "W/") {
+			if weak == false {
+				continue
+			}
+			candidate = candidate[2:]
+		}
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * Evaluates the conditional headers of a request modifying aliasPath against
+ * its current state, e.g. 'If-None-Match: *' only creates new files
+ * Returns the status to reply with or 0 if the request shall be served
+ */
+func checkModifyPreconditions(r *http.Request, aliasPath string) int {
+	fi, err := os.Stat(aliasPath)
+	if err != nil {
+		if r.Header.Get("If-Match") != "" {
+			return http.StatusPreconditionFailed // there is nothing to match
+		}
+		return 0
+	}
+	if fi.IsDir() {
+		return checkPreconditions(r, "", fi.ModTime()) // directories have no entity tag
+	}
+
+	content, err := ioutil.ReadFile(aliasPath)
+	if err != nil {
+		return http.StatusInternalServerError
+	}
+	var js rqMeta
+	if err := json.Unmarshal(content, &js); err != nil {
+		return http.StatusInternalServerError
+	}
+	return checkPreconditions(r, metaETag(js), time.Unix(js.Created, 0))
+}
@@ -0,0 +1,170 @@
+/*
+ * Copyright (C) 2015 Adrian Ulrich <adrian@blinkenlights.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package hgmweb
+
+import (
+	"bytes"
+	"libhgms/backend"
+	"libhgms/uploadtool"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestMetaETag(t *testing.T) {
+	rqm := rqMeta{Location: [][]string{{"file:///a", "file:///b"}}, Key: "00ff", ContentSize: 100, BlobSize: 60, Version: 2}
+	etag := metaETag(rqm)
+	if regexp.MustCompile(`^"[0-9a-f]{32}"$`).MatchString(etag) == false {
+		t.Fatalf("%s is not a strong entity tag", etag)
+	}
+
+	same := rqm
+	same.Created, same.ContentType = 1234, "text/plain"
+	if metaETag(same) != etag {
+		t.Fatalf("entity tag depends on fields not describing the content")
+	}
+
+	changes := []func(m *rqMeta){
+		func(m *rqMeta) { m.Key = "00fe" },
+		func(m *rqMeta) { m.ContentSize = 101 },
+		func(m *rqMeta) { m.BlobSize = 61 },
+		func(m *rqMeta) { m.Version = 1 },
+		func(m *rqMeta) { m.Location = [][]string{{"file:///a", "file:///c"}} },
+		func(m *rqMeta) { m.Location = append(m.Location, []string{"file:///c", "file:///d"}) },
+	}
+	for i, change := range changes {
+		changed := rqm
+		changed.Location = [][]string{{"file:///a", "file:///b"}}
+		change(&changed)
+		if metaETag(changed) == etag {
+			t.Errorf("change %d does not change the entity tag", i)
+		}
+	}
+}
+
+func TestEtagListMatches(t *testing.T) {
+	tests := []struct {
+		list string
+		weak bool
+		want bool
+	}{
+		{`"abc"`, false, true},
+		{`"xyz", "abc"`, false, true},
+		{`"xyz"`, false, false},
+		{`*`, false, true},
+		{`W/"abc"`, false, false},
+		{`W/"abc"`, true, true},
+		{`abc`, false, false},
+	}
+	for _, tt := range tests {
+		if got := etagListMatches(tt.list, `"abc"`, tt.weak); got != tt.want {
+			t.Errorf("%s (weak=%t): got %t, want %t", tt.list, tt.weak, got, tt.want)
+		}
+	}
+}
+
+func TestCheckPreconditions(t *testing.T) {
+	etag := `"abc"`
+	lastModified := time.Unix(1500000000, 0)
+	before := lastModified.Add(-time.Hour).UTC().Format(http.TimeFormat)
+	after := lastModified.Add(time.Hour).UTC().Format(http.TimeFormat)
+
+	tests := []struct {
+		method string
+		header string
+		value  string
+		want   int
+	}{
+		{"GET", "", "", 0},
+		{"GET", "If-Match", `"abc"`, 0},
+		{"GET", "If-Match", `"xyz"`, http.StatusPreconditionFailed},
+		{"GET", "If-Match", `W/"abc"`, http.StatusPreconditionFailed},
+		{"GET", "If-Unmodified-Since", after, 0},
+		{"GET", "If-Unmodified-Since", before, http.StatusPreconditionFailed},
+		{"GET", "If-None-Match", `"abc"`, http.StatusNotModified},
+		{"GET", "If-None-Match", `W/"abc"`, http.StatusNotModified},
+		{"HEAD", "If-None-Match", `*`, http.StatusNotModified},
+		{"GET", "If-None-Match", `"xyz"`, 0},
+		{"GET", "If-Modified-Since", after, http.StatusNotModified},
+		{"GET", "If-Modified-Since", before, 0},
+		{"PUT", "If-None-Match", `*`, http.StatusPreconditionFailed},
+		{"PUT", "If-Match", `"xyz"`, http.StatusPreconditionFailed},
+		{"DELETE", "If-Match", `"abc"`, 0},
+		{"DELETE", "If-Modified-Since", after, 0},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "/file", nil)
+		if tt.header != "" {
+			r.Header.Set(tt.header, tt.value)
+		}
+		if got := checkPreconditions(r, etag, lastModified); got != tt.want {
+			t.Errorf("%s with %s: %s: got %d, want %d", tt.method, tt.header, tt.value, got, tt.want)
+		}
+	}
+
+	// If-None-Match takes precedence over If-Modified-Since
+	r := httptest.NewRequest("GET", "/file", nil)
+	r.Header.Set("If-None-Match", `"xyz"`)
+	r.Header.Set("If-Modified-Since", after)
+	if got := checkPreconditions(r, etag, lastModified); got != 0 {
+		t.Errorf("If-Modified-Since was not ignored: got %d", got)
+	}
+}
+
+func TestModifyPreconditions(t *testing.T) {
+	dir := setupLocalProxy(t, "file.bin", []byte("some content"))
+	defer os.RemoveAll(dir)
+
+	be, err := backend.ForTarget("file://" + filepath.ToSlash(filepath.Join(dir, "blobs")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploadTool = uploadtool.New(be)
+	defer func() { uploadTool = nil }()
+
+	modify := func(method string, alias string, header string, value string) int {
+		rq := httptest.NewRequest(method, "/"+alias, bytes.NewReader([]byte("new content")))
+		rq.Header.Set(header, value)
+		return proxyRequest(t, dir, rq).Code
+	}
+	aliasExists := func(alias string) bool {
+		_, err := os.Stat(filepath.Join(dir, "_aliases", alias))
+		return err == nil
+	}
+	etag := proxyRequest(t, dir, httptest.NewRequest("HEAD", "/file.bin", nil)).Header().Get("ETag")
+
+	if code := modify("PUT", "file.bin", "If-None-Match", "*"); code != http.StatusPreconditionFailed {
+		t.Fatalf("PUT with If-None-Match: * of an existing alias returned %d", code)
+	}
+	if code := modify("PUT", "new.bin", "If-None-Match", "*"); code >= 300 || aliasExists("new.bin") == false {
+		t.Fatalf("PUT with If-None-Match: * of a new alias returned %d", code)
+	}
+	if code := modify("PUT", "other.bin", "If-Match", "*"); code != http.StatusPreconditionFailed || aliasExists("other.bin") {
+		t.Fatalf("PUT with If-Match of a new alias returned %d", code)
+	}
+	if code := modify("DELETE", "file.bin", "If-Match", `"outdated"`); code != http.StatusPreconditionFailed || aliasExists("file.bin") == false {
+		t.Fatalf("DELETE with an outdated If-Match returned %d", code)
+	}
+	if code := modify("DELETE", "file.bin", "If-Match", etag); code >= 300 || aliasExists("file.bin") {
+		t.Fatalf("DELETE with a matching If-Match returned %d", code)
+	}
+}
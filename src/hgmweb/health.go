@@ -0,0 +1,216 @@
+/*
+ * Copyright (C) 2015 Adrian Ulrich <adrian@blinkenlights.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package hgmweb
+
+import (
+	"encoding/json"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	healthFailureThreshold = 3                // consecutive failures opening the circuit of a host
+	healthMinBackoff       = 10 * time.Second // time until a failed host is probed again
+	healthMaxBackoff       = 10 * time.Minute
+	healthLatencyWeight    = 0.2 // weight of a new sample in the moving latency average
+)
+
+/* What we know about a single storage host */
+type hostHealth struct {
+	Latency             time.Duration `json:"-"` /* moving average of the time to the first byte */
+	Successes           int64
+	Failures            int64
+	ConsecutiveFailures int
+	RetryAt             time.Time /* the circuit is open until then */
+	LastError           string
+	backoff             time.Duration
+}
+
+/* Tracks the health of all hosts we fetch blobs from, shared by all requests */
+type healthTracker struct {
+	sync.Mutex
+	hosts map[string]*hostHealth
+}
+
+var replicaHealth = &healthTracker{hosts: make(map[string]*hostHealth)}
+
+/**
+ * Returns the indexes of the given blob locations in the order they should be tried:
+ * Healthy hosts sorted by latency, followed by hosts which recently failed, hosts
+ * which are due for a probe and hosts with an open circuit (which are only used
+ * if everything else fails)
+ */
+func (ht *healthTracker) order(locations []string) []int {
+	ht.Lock()
+	defer ht.Unlock()
+
+	now := time.Now()
+	rank := func(location string) (int, time.Duration) {
+		h := ht.hosts[hostOf(location)]
+		if h == nil {
+			return 0, 0 /* never seen: as good as the best host, so we get to know it */
+		} else if h.ConsecutiveFailures == 0 {
+			return 0, h.Latency
+		} else if h.ConsecutiveFailures < healthFailureThreshold {
+			return 1, h.Latency
+		} else if now.After(h.RetryAt) {
+			return 2, h.Latency
+		}
+		return 3, h.Latency
+	}
+
+	indexes := rand.Perm(len(locations)) /* random order between equal hosts */
+	sort.SliceStable(indexes, func(i, j int) bool {
+		ci, li := rank(locations[indexes[i]])
+		cj, lj := rank(locations[indexes[j]])
+		if ci != cj {
+			return ci < cj
+		}
+		return li < lj
+	})
+	return indexes
+}
+
+/**
+ * Records a successful fetch from location, latency is the time it took to get its header
+ */
+func (ht *healthTracker) success(location string, latency time.Duration) {
+	ht.Lock()
+	defer ht.Unlock()
+
+	h := ht.host(location)
+	if h.Successes == 0 && h.Latency == 0 {
+		h.Latency = latency
+	} else {
+		h.Latency += time.Duration(healthLatencyWeight * float64(latency-h.Latency))
+	}
+	h.Successes++
+	h.ConsecutiveFailures = 0
+	h.backoff = 0
+}
+
+/**
+ * Records a failed fetch from location, the circuit of its host is opened
+ * (again) if there were too many failures in a row
+ */
+func (ht *healthTracker) failure(location string, err error) {
+	ht.Lock()
+	defer ht.Unlock()
+
+	h := ht.host(location)
+	h.Failures++
+	h.ConsecutiveFailures++
+	h.LastError = healthError(location, err)
+
+	if h.ConsecutiveFailures >= healthFailureThreshold {
+		if h.backoff == 0 {
+			h.backoff = healthMinBackoff
+		} else if h.backoff < healthMaxBackoff {
+			h.backoff *= 2
+		}
+		if h.backoff > healthMaxBackoff {
+			h.backoff = healthMaxBackoff
+		}
+		h.RetryAt = time.Now().Add(h.backoff)
+	}
+}
+
+/**
+ * Returns the entry of the host of location, must be called while holding the lock
+ */
+func (ht *healthTracker) host(location string) *hostHealth {
+	key := hostOf(location)
+	h := ht.hosts[key]
+	if h == nil {
+		h = &hostHealth{}
+		ht.hosts[key] = h
+	}
+	return h
+}
+
+/**
+ * Writes the state of all hosts as json to w
+ */
+func (ht *healthTracker) writeJSON(w io.Writer) error {
+	type hostState struct {
+		hostHealth
+		LatencyMs float64
+		State     string
+	}
+
+	ht.Lock()
+	now := time.Now()
+	state := make(map[string]hostState)
+	for key, h := range ht.hosts {
+		hs := hostState{hostHealth: *h, LatencyMs: float64(h.Latency) / float64(time.Millisecond), State: "ok"}
+		if h.ConsecutiveFailures >= healthFailureThreshold {
+			hs.State = "open"
+			if now.After(h.RetryAt) {
+				hs.State = "probing"
+			}
+		}
+		state[key] = hs
+	}
+	ht.Unlock()
+
+	jsonBlob, err := json.MarshalIndent(state, "", "   ")
+	if err == nil {
+		_, err = w.Write(jsonBlob)
+	}
+	return err
+}
+
+/**
+ * Returns the description of err shown by the health endpoint, which is public:
+ * the location of the blob (and thus the file it belongs to) must not be part of it
+ */
+func healthError(location string, err error) string {
+	switch e := err.(type) {
+	case *url.Error:
+		err = e.Err
+	case *os.PathError:
+		err = e.Err
+	}
+	return strings.Replace(err.Error(), location, hostOf(location), -1)
+}
+
+/**
+ * Returns the host serving location, blobs in local directories share a single entry
+ */
+func hostOf(location string) string {
+	u, err := url.Parse(location)
+	if err != nil {
+		return location
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+/**
+ * Admin endpoint: returns the state of the replica health tracker as json
+ */
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	replicaHealth.writeJSON(w)
+}
@@ -0,0 +1,46 @@
+/*
+ * Copyright (C) 2015 Adrian Ulrich <adrian@blinkenlights.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package hgmweb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestHealthHidesLocations(t *testing.T) {
+	ht := &healthTracker{hosts: make(map[string]*hostHealth)}
+	remote := "https://farm1.example.com/1234/secret_abcdef.png"
+	local := "file:///srv/blobs/ab/secret.png"
+
+	ht.failure(remote, fmt.Errorf("%s returned HTTP status %d", remote, 404))
+	ht.failure(remote, &url.Error{Op: "Get", URL: remote, Err: errors.New("connection refused")})
+	ht.failure(local, &os.PathError{Op: "open", Path: "/srv/blobs/ab/secret.png", Err: os.ErrNotExist})
+
+	buf := &bytes.Buffer{}
+	if err := ht.writeJSON(buf); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "secret") {
+		t.Fatalf("health state contains a blob location: %s", buf.String())
+	}
+}
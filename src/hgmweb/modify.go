@@ -0,0 +1,172 @@
+/*
+ * Copyright (C) 2015 Adrian Ulrich <adrian@blinkenlights.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package hgmweb
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"libhgms/stattool"
+	"libhgms/uploadtool"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+)
+
+/* Stores uploaded files, nil if the proxy is read-only */
+var uploadTool *uploadtool.UploadTool
+
+/**
+ * Handles all requests modifying the alias tree
+ * Returns false if the request method is not one of ours
+ */
+func handleModify(w http.ResponseWriter, r *http.Request, aliasPath string) bool {
+	switch r.Method {
+	case "PUT", "DELETE", "MOVE", "MKCOL":
+	default:
+		return false
+	}
+
+	if status := checkModifyPreconditions(r, aliasPath); status != 0 {
+		w.WriteHeader(status)
+		return true
+	}
+
+	var err error
+	switch r.Method {
+	case "PUT":
+		err = putAlias(r, aliasPath)
+	case "DELETE":
+		err = deleteAlias(aliasPath)
+	case "MOVE":
+		err = moveAlias(r, aliasPath)
+	case "MKCOL":
+		err = mkdirAlias(aliasPath)
+	}
+
+	if err != nil {
+		fmt.Printf("%s %s failed: %s\n", r.Method, aliasPath, err)
+	}
+
+	w.WriteHeader(stattool.SysErrToHttpStatus(sysErr(err)))
+	return true
+}
+
+/**
+ * Encrypts and uploads the request body, the alias at aliasPath
+ * will point to the new data afterwards
+ */
+func putAlias(r *http.Request, aliasPath string) error {
+	if uploadTool == nil {
+		return syscall.EROFS
+	}
+
+	if fi, err := os.Stat(aliasPath); err == nil && fi.IsDir() {
+		return syscall.EISDIR
+	}
+
+	// Spool the body to disk: we need to know its size before uploading anything
+	spool, err := ioutil.TempFile("", "hgmweb-put")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	size, err := io.Copy(spool, r.Body)
+	if err != nil {
+		return err
+	}
+	_, err = spool.Seek(0, 0)
+	if err != nil {
+		return err
+	}
+
+	meta, err := uploadtool.NewMeta(size)
+	if err != nil {
+		return err
+	}
+
+	err = uploadTool.AddReplica(meta, spool)
+	if err != nil {
+		return err
+	}
+
+	// The blobs of a replaced file are left alone: other aliases may still
+	// refer to them, removing unused blobs is up to the user
+	return uploadtool.WriteMeta(aliasPath, meta)
+}
+
+/**
+ * Removes the file or (empty) directory at aliasPath
+ */
+func deleteAlias(aliasPath string) error {
+	if uploadTool == nil {
+		return syscall.EROFS
+	}
+
+	return os.Remove(aliasPath)
+}
+
+/**
+ * Renames aliasPath to the location given in the Destination header
+ */
+func moveAlias(r *http.Request, aliasPath string) error {
+	if uploadTool == nil {
+		return syscall.EROFS
+	}
+
+	dstUrl, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil {
+		return syscall.EINVAL
+	}
+
+	dstPath := path.Clean(dstUrl.Path)
+	if strings.HasPrefix(dstPath, proxyConfig.Webroot) == false {
+		return syscall.EXDEV
+	}
+	dstAliasPath := fmt.Sprintf("./_aliases/%s", dstPath[len(proxyConfig.Webroot):])
+
+	return os.Rename(aliasPath, dstAliasPath)
+}
+
+/**
+ * Creates a new directory at aliasPath
+ */
+func mkdirAlias(aliasPath string) error {
+	if uploadTool == nil {
+		return syscall.EROFS
+	}
+	return os.Mkdir(aliasPath, 0755)
+}
+
+/**
+ * Returns the plain syscall error of err
+ */
+func sysErr(err error) error {
+	switch e := err.(type) {
+	case *os.PathError:
+		return e.Err
+	case *os.LinkError:
+		return e.Err
+	}
+	return err
+}
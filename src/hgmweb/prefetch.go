@@ -0,0 +1,96 @@
+/*
+ * Copyright (C) 2015 Adrian Ulrich <adrian@blinkenlights.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package hgmweb
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+const (
+	prefetchChunkSize  = 64 * 1024       // size of the buffers handed from the fetcher to the client
+	prefetchBufferSize = 4 * 1024 * 1024 // maximum amount of data buffered per prefetched blob
+)
+
+var errFetchCancelled = errors.New("prefetch cancelled")
+
+/* A blob segment decrypted in the background */
+type blobFetch struct {
+	chunks chan []byte
+	done   chan struct{} /* closed to stop the fetcher          */
+	once   sync.Once
+	err    error /* result of streamBlob, valid once chunks is closed */
+}
+
+/**
+ * Starts fetching seg in the background, at most prefetchBufferSize bytes
+ * are buffered until the data is consumed by copyTo
+ */
+func startBlobFetch(rqm rqMeta, key []byte, seg blobSegment) *blobFetch {
+	bf := &blobFetch{
+		chunks: make(chan []byte, prefetchBufferSize/prefetchChunkSize),
+		done:   make(chan struct{}),
+	}
+	go func() {
+		bf.err = serveSegment(bf, rqm, key, seg)
+		close(bf.chunks)
+	}()
+	return bf
+}
+
+/**
+ * Queues a copy of p, blocks while the buffer is full
+ */
+func (bf *blobFetch) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		n := len(p) - written
+		if n > prefetchChunkSize {
+			n = prefetchChunkSize
+		}
+		chunk := make([]byte, n)
+		copy(chunk, p[written:])
+		select {
+		case bf.chunks <- chunk:
+			written += n
+		case <-bf.done:
+			return written, errFetchCancelled
+		}
+	}
+	return written, nil
+}
+
+/**
+ * Writes the fetched data to dst, returns once the fetch completed
+ */
+func (bf *blobFetch) copyTo(dst io.Writer) error {
+	for chunk := range bf.chunks {
+		if _, err := dst.Write(chunk); err != nil {
+			return err
+		}
+	}
+	return bf.err
+}
+
+/**
+ * Stops the fetcher, the buffered data is dropped
+ */
+func (bf *blobFetch) cancel() {
+	bf.once.Do(func() { close(bf.done) })
+}
@@ -18,28 +18,38 @@
 package hgmweb
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"libhgms/backend"
 	"libhgms/crypto/aestool"
 	"libhgms/flickr/png"
 	"libhgms/stattool"
-	"math/rand"
+	"libhgms/uploadtool"
+	"log"
+	"mime"
+	"mime/multipart"
 	"net/http"
+	"net/textproto"
 	"net/url"
 	"os"
+	"os/signal"
+	"path"
 	"regexp"
-	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
-/* Custom HTTP Client, setup done in main() */
-var backendClient *http.Client
 var proxyConfig *proxyParams
-var reHttpRange = regexp.MustCompile("^bytes=([0-9]+)-$")
+
+var errNoReplicas = errors.New("Metadata lists no replicas")
 
 /* Proxy configuration */
 type proxyParams struct {
@@ -49,16 +59,23 @@ type proxyParams struct {
 	Webroot  string /* prefix www root */
 	Assets   string /* prefix of static files */
 	StatSvc  string /* stat service */
+	Health   string /* replica health state, not served if empty */
+	Prefetch int    /* number of blobs to fetch ahead */
+	Warmup   string /* prefix of the cache warm-up service */
 }
 
 type rqMeta struct {
-	Location     [][]string /* Raw HTTP URL            */
-	Key          string     /* 7-bit ascii hex string  */
-	Attachment   string     /* Filename to use on forced download */
-	Created      int64      /* file-creation timestamp */
-	BlobSize     int64
-	RangeRequest bool
-	RangeFrom    int64
+	Location    [][]string /* Blob URLs, see backend  */
+	Key         string     /* 7-bit ascii hex string  */
+	Attachment  string     /* Filename to use on forced download */
+	ContentType string     /* Content-Type to send, guessed from the filename */
+	ETag        string     /* entity tag, see metaETag */
+	Created     int64      /* file-creation timestamp */
+	ContentSize int64
+	BlobSize    int64
+	Version     int /* encryption format, see aestool */
+
+	ContentSha256 string /* hex encoded digest of the content, may be empty */
 }
 
 const (
@@ -67,9 +84,25 @@ const (
 	FORMAT_M3U      = "m3u"
 )
 
-func LaunchProxy(bindAddr string, bindPort string, rqPrefix string) {
+/* Settings of the proxy, see LaunchProxy */
+type ProxyOptions struct {
+	BindAddr     string /* IPv4 address to bind to */
+	BindPort     string /* port to listen on */
+	Prefix       string /* webroot prefix */
+	UploadTarget string /* where to store files uploaded by clients, read-only if empty */
+	UploadLayout string /* PNG layout of uploaded blobs */
+	Prefetch     int    /* number of upcoming blobs to fetch in the background */
+	CachePath    string /* file of the blob cache, disabled if empty */
+	CacheSize    int    /* size of the blob cache in MB */
+	CacheSync    bool   /* flush each change of the blob cache to disk */
+	LocalRoot    string /* serve blobs with file:// locations from this directory */
+	Health       bool   /* serve the health state of all hosts, which reveals where blobs are stored */
+}
+
+func LaunchProxy(opts ProxyOptions) {
 
 	// rqPrefix should always START with a slash AND end with a slassh
+	rqPrefix := opts.Prefix
 	if len(rqPrefix) == 0 {
 		rqPrefix = "/"
 	} else {
@@ -82,26 +115,80 @@ func LaunchProxy(bindAddr string, bindPort string, rqPrefix string) {
 	}
 
 	proxyConfig = new(proxyParams)
-	proxyConfig.BindAddr = bindAddr
-	proxyConfig.BindPort = bindPort
+	proxyConfig.BindAddr = opts.BindAddr
+	proxyConfig.BindPort = opts.BindPort
 	proxyConfig.BindTo = fmt.Sprintf("%s:%s", proxyConfig.BindAddr, proxyConfig.BindPort) // fixme: ipv6?
 	proxyConfig.Webroot = rqPrefix
 	proxyConfig.Assets = ".assets/"
 	proxyConfig.StatSvc = stattool.StatSvcEndpoint + "/"
+	if opts.Health {
+		proxyConfig.Health = ".health"
+	}
+	proxyConfig.Prefetch = opts.Prefetch
+	proxyConfig.Warmup = ".warmup/"
+
+	if len(opts.CachePath) > 0 {
+		if err := openBlobCache(opts.CachePath, opts.CacheSize, opts.CacheSync); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Blobs with file:// locations are only served from this directory (and the upload target)
+	if len(opts.LocalRoot) > 0 {
+		if err := backend.AllowLocalRoot(opts.LocalRoot); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Clients may only modify the alias tree if we know where to put new blobs
+	if len(opts.UploadTarget) > 0 {
+		be, err := backend.ForTarget(opts.UploadTarget)
+		if err != nil {
+			log.Fatal(err)
+		}
+		uploadTool = uploadtool.New(be)
+		uploadTool.Layout = opts.UploadLayout
+	}
 	startServer()
+
+	// an unclean database must be verified on the next start
+	closeBlobCache()
 }
 
+/**
+ * Serves requests until we receive SIGINT or SIGTERM, returns once all
+ * active requests were finished (or after a few seconds)
+ */
 func startServer() {
-	tr := &http.Transport{ResponseHeaderTimeout: 5 * time.Second, Proxy: http.ProxyFromEnvironment}
-	backendClient = &http.Client{Transport: tr}
-
 	fmt.Printf("Proxy accepting connections at http://%s%s\n", proxyConfig.BindTo, proxyConfig.Webroot)
 
 	http.HandleFunc(fmt.Sprintf("%s", proxyConfig.Webroot), handleAlias)
 	http.HandleFunc(fmt.Sprintf("%s%s", proxyConfig.Webroot, proxyConfig.Assets), handleAsset)
 	http.HandleFunc(fmt.Sprintf("%s%s", proxyConfig.Webroot, proxyConfig.StatSvc), handleStat)
-
-	http.ListenAndServe(proxyConfig.BindTo, nil)
+	if len(proxyConfig.Health) > 0 {
+		http.HandleFunc(fmt.Sprintf("%s%s", proxyConfig.Webroot, proxyConfig.Health), handleHealth)
+	}
+	http.HandleFunc(fmt.Sprintf("%s%s", proxyConfig.Webroot, proxyConfig.Warmup), handleWarmup)
+
+	server := &http.Server{Addr: proxyConfig.BindTo}
+	stopped := make(chan bool)
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		sig := <-sigs
+		fmt.Printf("Shutting down on %v\n", sig)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		server.Shutdown(ctx)
+		cancel()
+		close(stopped)
+	}()
+
+	err := server.ListenAndServe()
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-stopped
 }
 
 func handleAsset(w http.ResponseWriter, r *http.Request) {
@@ -124,22 +211,33 @@ func handleAsset(w http.ResponseWriter, r *http.Request) {
 func handleStat(w http.ResponseWriter, r *http.Request) {
 	unEscapedRqUri := r.URL.Path
 	unEscapedRqUri = unEscapedRqUri[len(proxyConfig.StatSvc)+len(proxyConfig.Webroot):]
-	readDirRequested := r.URL.Query().Get("op") == "readdir"
+	op := r.URL.Query().Get("op")
 
 	aliasPath := fmt.Sprintf("./_aliases/%s", unEscapedRqUri)
 
 	var jsonBlob []byte
 	var sysErr error
 
-	if readDirRequested == true {
+	if op == "readdir" {
 		dirList, dirErr := stattool.LocalReadDir(aliasPath)
 		if dirErr == nil {
 			jsonBlob, dirErr = json.Marshal(dirList)
 		}
 		sysErr = dirErr
+	} else if op == "readdirplus" {
+		// same as readdir, but with the attributes of each entry
+		dirList, dirErr := stattool.LocalReadDirPlus(aliasPath)
+		if dirErr == nil {
+			for i := range dirList {
+				exportMode(&dirList[i].Attr)
+			}
+			jsonBlob, dirErr = json.Marshal(dirList)
+		}
+		sysErr = dirErr
 	} else {
 		fileStat, fileErr := stattool.LocalStat(aliasPath)
 		if fileErr == nil {
+			exportMode(fileStat)
 			jsonBlob, fileErr = json.Marshal(fileStat)
 		}
 		sysErr = fileErr
@@ -152,6 +250,15 @@ func handleStat(w http.ResponseWriter, r *http.Request) {
 	io.WriteString(w, string(jsonBlob))
 }
 
+/**
+ * Adjusts the mode returned by the stat service to what clients may do
+ */
+func exportMode(attr *stattool.HgmStatAttr) {
+	if uploadTool == nil {
+		attr.Mode &= 0555 // kill all write bits -> we are read only
+	}
+}
+
 func handleAlias(w http.ResponseWriter, r *http.Request) {
 
 	deliveryFormat := r.URL.Query().Get("format")
@@ -159,7 +266,11 @@ func handleAlias(w http.ResponseWriter, r *http.Request) {
 	unEscapedRqUri = unEscapedRqUri[len(proxyConfig.Webroot):]
 
 	aliasPath := fmt.Sprintf("./_aliases/%s", unEscapedRqUri)
-	fmt.Printf("GET=%s, raw=%s, format=%s\n", aliasPath, r.URL.Path, deliveryFormat)
+	fmt.Printf("%s=%s, raw=%s, format=%s\n", r.Method, aliasPath, r.URL.Path, deliveryFormat)
+
+	if handleModify(w, r, aliasPath) {
+		return
+	}
 
 	fi, err := os.Stat(aliasPath)
 	if err != nil {
@@ -211,138 +322,386 @@ func handleAlias(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	clientIMS, _ := time.Parse(http.TimeFormat, r.Header.Get("If-Modified-Since"))
-	if clientIMS.Unix() > 0 && js.Created <= clientIMS.Unix() {
-		w.WriteHeader(http.StatusNotModified)
-		io.WriteString(w, "Not modified")
+	js.ETag = metaETag(js)
+	lastModified := time.Unix(js.Created, 0)
+
+	if status := checkPreconditions(r, js.ETag, lastModified); status != 0 {
+		w.Header().Set("ETag", js.ETag)
+		w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+		w.WriteHeader(status)
 		return
 	}
+	rangeHeader := r.Header.Get("Range")
+	if ifRangeMatches(r, js.ETag, lastModified) == false {
+		rangeHeader = "" /* the client has an outdated copy: send the whole file */
+	}
 
-	rangeMatches := reHttpRange.FindStringSubmatch(r.Header.Get("Range"))
-	if len(rangeMatches) == 2 { /* [0]=text, [1]=range_bytes */
-		js.RangeFrom, _ = strconv.ParseInt(rangeMatches[1], 10, 64)
-		js.RangeRequest = true
-	} else {
-		js.RangeFrom = 0
-		js.RangeRequest = false
+	ranges, err := parseRange(rangeHeader, js.ContentSize)
+	if err == errUnsatisfiableRange {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", js.ContentSize))
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	if err != nil {
+		ranges = nil /* invalid ranges are ignored */
 	}
 
-	if js.RangeFrom == 0 && deliveryFormat == FORMAT_DOWNLOAD {
+	if (len(ranges) == 0 || ranges[0].start == 0) && deliveryFormat == FORMAT_DOWNLOAD {
 		js.Attachment = getFilename(unEscapedRqUri)
 	}
+	js.ContentType = mime.TypeByExtension(path.Ext(unEscapedRqUri))
 
-	fmt.Printf("HTTP: Range-Request for offset %d, raw=%s, attachment=%s\n", js.RangeFrom, r.Header.Get("Range"), js.Attachment)
+	fmt.Printf("HTTP: %s with %d range(s) %v, raw=%s, attachment=%s\n", r.Method, len(ranges), ranges, r.Header.Get("Range"), js.Attachment)
 
 	/* We got all required info: serve HTTP request to client */
-	serveFullURI(w, r, js)
+	serveFullURI(w, r, js, ranges)
 }
 
 /*
- * Handle request for given targetURI
+ * Handle request for given targetURI: sends the whole file or the requested ranges
+ * HEAD requests are answered using the metadata only
  */
-
-func serveFullURI(dst http.ResponseWriter, rq *http.Request, rqm rqMeta) {
+func serveFullURI(dst http.ResponseWriter, rq *http.Request, rqm rqMeta, ranges []byteRange) {
 
 	/* Our encryption key is stored as an hex-ascii string
 	 * within the JSON file */
 	key := make([]byte, len(rqm.Key)/2)
 	hex.Decode(key, []byte(rqm.Key))
 
-	headersSent := false                /* True if we already sent the http header */
-	locArray := rqm.Location            /* Array with all blob locations           */
-	numCopies := len(locArray)          /* Number of replicas in rqmeta            */
-	numBlobs := int64(len(locArray[0])) /* Total number of blobs                   */
-	skipBytes := rqm.RangeFrom          /* How many bytes shall we throw away?     */
+	hdr := dst.Header()
+	hdr.Set("Last-Modified", time.Unix(rqm.Created, 0).Format(http.TimeFormat))
+	hdr.Set("Accept-Ranges", "bytes")
+	hdr.Set("ETag", rqm.ETag)
 
-	/* fixme: div-by-zero: should we care? */
-	bIdx := int64(skipBytes / rqm.BlobSize)
-	skipBytes -= bIdx * rqm.BlobSize // offset to use in bIdx
+	// Digest of the whole file (RFC 3230), also sent on partial responses
+	if digest, err := hex.DecodeString(rqm.ContentSha256); err == nil && len(digest) == sha256.Size {
+		hdr.Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(digest))
+	}
 
-	fmt.Printf("# stream has %d location(s) and %d chunks, firstBlob is: %d, skip=%d\n", numCopies, numBlobs, bIdx, skipBytes)
+	// Caller requested us to send a predefined filename
+	if len(rqm.Attachment) > 0 {
+		hdr.Set("Content-Disposition", fmt.Sprintf(`attachment: filename="%s"`, escapeQuotes(rqm.Attachment)))
+	}
 
-	for ; bIdx < numBlobs; bIdx++ {
-		copyList := rand.Perm(numCopies)
-		fmt.Printf("== serving blob %d/%d\n", bIdx+1, numBlobs)
+	partType := "application/octet-stream"
+	if len(rqm.ContentType) > 0 {
+		partType = rqm.ContentType
+		hdr.Set("Content-Type", rqm.ContentType)
+	}
 
-		servedCopy := false
-		for _, ci := range copyList {
-			currentURI := locArray[ci][bIdx]
-			fmt.Printf("  >> replica %d -> checking %s\n", ci, currentURI)
+	status := http.StatusPartialContent
+	var writeBody func(w io.Writer) error
 
-			backendRQ, err := http.NewRequest("GET", currentURI, nil)
-			if err != nil {
-				continue
+	if len(ranges) == 0 {
+		status = http.StatusOK
+		hdr.Set("Content-Length", fmt.Sprintf("%d", rqm.ContentSize))
+		writeBody = func(w io.Writer) error {
+			return streamContent(w, rqm, key, 0, rqm.ContentSize)
+		}
+	} else if len(ranges) == 1 {
+		rng := ranges[0]
+		hdr.Set("Content-Length", fmt.Sprintf("%d", rng.length))
+		hdr.Set("Content-Range", rangeHeader(rng, rqm.ContentSize))
+		writeBody = func(w io.Writer) error {
+			return streamContent(w, rqm, key, rng.start, rng.length)
+		}
+	} else {
+		/* multipart/byteranges: the size of the body is known as we can create all part headers upfront */
+		var bodySize countingWriter
+		mw := multipart.NewWriter(&bodySize)
+		for _, rng := range ranges {
+			mw.CreatePart(rangePartHeader(rng, rqm.ContentSize, partType))
+			bodySize += countingWriter(rng.length)
+		}
+		mw.Close()
+
+		boundary := mw.Boundary()
+		hdr.Set("Content-Length", fmt.Sprintf("%d", bodySize))
+		hdr.Set("Content-Type", "multipart/byteranges; boundary="+boundary)
+		writeBody = func(w io.Writer) error {
+			bw := multipart.NewWriter(w)
+			bw.SetBoundary(boundary)
+			for _, rng := range ranges {
+				pw, err := bw.CreatePart(rangePartHeader(rng, rqm.ContentSize, partType))
+				if err == nil {
+					err = streamContent(pw, rqm, key, rng.start, rng.length)
+				}
+				if err != nil {
+					return err
+				}
 			}
+			return bw.Close()
+		}
+	}
 
-			backendResp, err := backendClient.Do(backendRQ)
-			if err != nil {
-				continue
-			}
+	if rq.Method == "HEAD" {
+		dst.WriteHeader(status)
+		return
+	}
 
-			pngReader, err := flickr.NewReader(backendResp.Body, aestool.GetCipherBlockSize())
-			if err != nil {
-				backendResp.Body.Close()
-				continue
+	lw := &lazyHeaderWriter{w: dst, status: status}
+	err := writeBody(lw)
+	if err != nil {
+		fmt.Printf("failed to deliver content: %s\n", err)
+		if lw.sent == false {
+			hdr.Del("Content-Length")
+			hdr.Del("Content-Range")
+			hdr.Set("Content-Type", "text/plain")
+			dst.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(dst, "Internal server error :-(\n")
+		}
+	}
+}
+
+/*
+ * Decrypts length bytes of content, starting at offset from, and writes them to dst
+ * Up to proxyConfig.Prefetch upcoming blobs are fetched in the background
+ */
+func streamContent(dst io.Writer, rqm rqMeta, key []byte, from int64, length int64) error {
+	if length == 0 {
+		return nil // empty files are stored without any blobs
+	}
+	if len(rqm.Location) == 0 {
+		return errNoReplicas
+	}
+
+	segments := planSegments(rqm, from, length)
+	fetches := make([]*blobFetch, len(segments))
+	defer func() {
+		for _, bf := range fetches {
+			if bf != nil {
+				bf.cancel()
 			}
+		}
+	}()
 
-			err = pngReader.InitReader()
-			if err != nil {
-				backendResp.Body.Close()
-				continue
+	fmt.Printf("# stream has %d location(s) and %d chunks, serving %d, offset=%d, length=%d\n", len(rqm.Location), len(rqm.Location[0]), len(segments), from, length)
+
+	for si, seg := range segments {
+		for pi := si + 1; pi <= si+proxyConfig.Prefetch && pi < len(segments); pi++ {
+			if fetches[pi] == nil {
+				fetches[pi] = startBlobFetch(rqm, key, segments[pi])
 			}
+		}
 
-			if headersSent == false {
-				headersSent = true
-				dst.Header().Set("Last-Modified", time.Unix(rqm.Created, 0).Format(http.TimeFormat))
-				dst.Header().Set("Accept-Range", "bytes")
+		fmt.Printf("== serving blob %d/%d\n", seg.blob+1, len(rqm.Location[0]))
 
-				// Caller requested us to send a predefined filename
-				if len(rqm.Attachment) > 0 {
-					dst.Header().Set("Content-Disposition", fmt.Sprintf(`attachment: filename="%s"`, escapeQuotes(rqm.Attachment)))
-				}
+		var err error
+		if fetches[si] != nil {
+			err = fetches[si].copyTo(dst)
+		} else {
+			err = serveSegment(dst, rqm, key, seg)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-				// Send correct content length and range for this case
-				if rqm.RangeRequest == false {
-					dst.Header().Set("Content-Length", fmt.Sprintf("%d", pngReader.ContentSize))
-					dst.WriteHeader(http.StatusOK)
-				} else {
-					dst.Header().Set("Content-Length", fmt.Sprintf("%d", pngReader.ContentSize-rqm.RangeFrom))
-					dst.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", rqm.RangeFrom, pngReader.ContentSize-1, pngReader.ContentSize))
-					dst.WriteHeader(http.StatusPartialContent)
-				}
-			}
+/* The part of a single blob needed to serve a request */
+type blobSegment struct {
+	blob   int64 /* index of the blob              */
+	skip   int64 /* plaintext bytes to skip in it  */
+	length int64 /* plaintext bytes to send        */
+}
 
-			aes, err := aestool.New(pngReader.BlobSize, key, pngReader.IV)
-			if err != nil {
-				panic(err) /* this would most likely be a bug in pngReader.InitReader() */
-			}
+/**
+ * Splits the content range starting at offset from into the blobs holding it
+ */
+func planSegments(rqm rqMeta, from int64, length int64) []blobSegment {
+	segments := make([]blobSegment, 0)
+	numBlobs := int64(len(rqm.Location[0]))
 
-			fmt.Printf("  >> replica %d is ok, starting copy stream..., sb=%d\n", ci, skipBytes)
-			aes.SetSkipBytes(skipBytes)
-			err = aes.DecryptStream(dst, pngReader)
-			backendResp.Body.Close()
+	/* fixme: div-by-zero: should we care? */
+	bIdx := int64(from / rqm.BlobSize)
+	skipBytes := from - bIdx*rqm.BlobSize // offset to use in bIdx
 
-			if err != nil {
-				fmt.Printf("  >> breaking due to error: %s\n", err)
-				break
-			}
+	for ; bIdx < numBlobs && length > 0; bIdx++ {
+		n := rqm.BlobSize - skipBytes
+		if n > length {
+			n = length
+		}
+		segments = append(segments, blobSegment{blob: bIdx, skip: skipBytes, length: n})
+		length -= n
+		// first block is done: there will be nothing to skip on any other blocks
+		skipBytes = 0
+	}
+	if length > 0 {
+		// metadata claims more content than its blobs hold: let the last one fail
+		segments = append(segments, blobSegment{blob: numBlobs, length: length})
+	}
+	return segments
+}
+
+/**
+ * Decrypts seg and writes it to rw, which must accept exactly seg.length bytes
+ * Replicas are tried in the order suggested by replicaHealth: if one fails we
+ * continue with the next one at the byte where the last one stopped
+ */
+func streamBlob(rw *rangeWriter, rqm rqMeta, key []byte, seg blobSegment) error {
+	locArray := rqm.Location   /* Array with all blob locations           */
+	numCopies := len(locArray) /* Number of replicas in rqmeta            */
+	bIdx := seg.blob           /* The blob to serve                       */
+	skipBytes := seg.skip      /* How many bytes shall we throw away?     */
+	blobVersion := rqm.Version /* Encryption format used by all blobs     */
+
+	if blobVersion == 0 {
+		blobVersion = aestool.VERSION_CBC
+	}
+	if bIdx >= int64(len(locArray[0])) {
+		return io.ErrUnexpectedEOF
+	}
+
+	replicaURIs := make([]string, numCopies)
+	for ci := range replicaURIs {
+		replicaURIs[ci] = locArray[ci][bIdx]
+	}
+	copyList := replicaHealth.order(replicaURIs)
+
+	servedCopy := false
+	for _, ci := range copyList {
+		currentURI := locArray[ci][bIdx]
+		fmt.Printf("  >> replica %d -> checking %s\n", ci, currentURI)
+
+		be, err := backend.ForLocation(currentURI)
+		if err != nil {
+			continue
+		}
+
+		fetchStart := time.Now()
+		blobReader, err := be.Get(currentURI, 0, -1)
+		if err != nil {
+			fmt.Printf("  >> replica %d is unusable: %s\n", ci, describeBlobError(err))
+			replicaHealth.failure(currentURI, err)
+			continue
+		}
+
+		pngReader, err := flickr.NewReader(blobReader, aestool.GetCipherBlockSize())
+		if err != nil {
+			blobReader.Close()
+			continue
+		}
+
+		err = pngReader.InitReader()
+		if err != nil {
+			fmt.Printf("  >> replica %d is unusable: %s\n", ci, describeBlobError(err))
+			recordBlobError(currentURI, err)
+			blobReader.Close()
+			continue
+		}
+		replicaHealth.success(currentURI, time.Since(fetchStart))
 
-			servedCopy = true
-			break
+		// The image must not be able to downgrade us to an unauthenticated format
+		if pngReader.Version != blobVersion {
+			fmt.Printf("  >> replica %d has wrong format version %d (expected %d)\n", ci, pngReader.Version, blobVersion)
+			blobReader.Close()
+			continue
 		}
 
-		if servedCopy == false {
-			if headersSent == false {
-				dst.WriteHeader(http.StatusInternalServerError)
-				io.WriteString(dst, "Internal server error :-(\n")
+		aes, err := aestool.NewVersion(blobVersion, pngReader.BlobSize, key, pngReader.IV)
+		if err != nil {
+			blobReader.Close()
+			continue
+		}
+		aes.SetBlob(int(bIdx), rqm.ContentSize)
+
+		// Only decrypt what we are going to send
+		discard, err := aes.SetOffset(skipBytes)
+		if err == nil && discard > 0 && pngReader.Seekable() {
+			// No need to download the skipped part: request the image starting at the scanline we need
+			fileOffset, _ := pngReader.SeekOffset(discard)
+			blobReader.Close()
+			blobReader, err = be.Get(currentURI, fileOffset, -1)
+			if err != nil {
+				fmt.Printf("  >> replica %d is unusable: %s\n", ci, describeBlobError(err))
+				replicaHealth.failure(currentURI, err)
+				continue
 			}
-			fmt.Printf("failed to deliver blob %d, aborting request\n", bIdx+1)
-			break
+			err = pngReader.ResumeAt(blobReader, discard)
+		} else if err == nil {
+			err = pngReader.Skip(discard)
 		}
-		// first block is done: there will be nothing to skip on any other blocks
-		skipBytes = 0
+		if err != nil {
+			fmt.Printf("  >> replica %d is unusable: %s\n", ci, describeBlobError(err))
+			recordBlobError(currentURI, err)
+			blobReader.Close()
+			continue
+		}
+
+		fmt.Printf("  >> replica %d is ok, starting copy stream..., sb=%d, discarded=%d\n", ci, skipBytes, discard)
+		remainBefore := rw.remain
+		err = aes.DecryptStream(rw, pngReader)
+		blobReader.Close()
+
+		if err != nil && rw.err != nil {
+			return err // the client went away: there is nobody to fail over for
+		}
+		if err != nil && rw.remain > 0 {
+			recordBlobError(currentURI, err)
+			// resume from the next replica at exactly the byte where this one stopped
+			written := remainBefore - rw.remain
+			skipBytes += written
+			fmt.Printf("  >> replica %d failed after %d bytes: %s\n", ci, written, describeBlobError(err))
+			continue
+		}
+
+		servedCopy = true
+		break
 	}
 
+	if servedCopy == false {
+		return fmt.Errorf("failed to deliver blob %d", bIdx+1)
+	}
+	if rw.remain > 0 {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+/**
+ * Returns a description of an error encountered while reading a blob,
+ * telling corrupted blobs apart from backend errors
+ */
+func describeBlobError(err error) string {
+	switch err.(type) {
+	case flickr.FormatError:
+		return fmt.Sprintf("corrupted image: %s", err)
+	}
+	if err == aestool.ErrAuthFailed {
+		return fmt.Sprintf("corrupted content: %s", err)
+	}
+	return fmt.Sprintf("read error: %s", err)
+}
+
+/**
+ * Counts err against the host of location if the host (and not the blob) is to blame
+ */
+func recordBlobError(location string, err error) {
+	switch err.(type) {
+	case flickr.FormatError:
+		return
+	}
+	if err != aestool.ErrAuthFailed {
+		replicaHealth.failure(location, err)
+	}
+}
+
+/**
+ * Returns the value of the Content-Range header for rng
+ */
+func rangeHeader(rng byteRange, size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", rng.start, rng.start+rng.length-1, size)
+}
+
+/**
+ * Returns the header of a multipart/byteranges part
+ */
+func rangePartHeader(rng byteRange, size int64, contentType string) textproto.MIMEHeader {
+	return textproto.MIMEHeader{
+		"Content-Range": {rangeHeader(rng, size)},
+		"Content-Type":  {contentType},
+	}
 }
 
 /**
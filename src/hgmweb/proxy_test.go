@@ -0,0 +1,161 @@
+/*
+ * Copyright (C) 2015 Adrian Ulrich <adrian@blinkenlights.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package hgmweb
+
+import (
+	"bytes"
+	"io/ioutil"
+	"libhgms/backend"
+	"libhgms/uploadtool"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Stores content at alias in a local directory and returns the proxy serving it,
+// no network is involved
+func setupLocalProxy(t *testing.T, alias string, content []byte) (dir string) {
+	dir, err := ioutil.TempDir("", "hgms-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	be, err := backend.ForTarget("file://" + filepath.ToSlash(filepath.Join(dir, "blobs")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	meta, err := uploadtool.NewMeta(int64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta.BlobSize = int64(len(content)/3 + 1) // spread the content across multiple blobs
+	up := uploadtool.New(be)
+	if err := up.AddReplica(meta, bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := uploadtool.WriteMeta(filepath.Join(dir, "_aliases", alias), meta); err != nil {
+		t.Fatal(err)
+	}
+
+	proxyConfig = &proxyParams{Webroot: "/", StatSvc: ".statsvc/", Prefetch: 1}
+	return dir
+}
+
+// Runs a request against the proxy, which serves the alias tree of the current directory
+func proxyRequest(t *testing.T, dir string, rq *http.Request) *httptest.ResponseRecorder {
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+
+	w := httptest.NewRecorder()
+	handleAlias(w, rq)
+	return w
+}
+
+func TestProxyLocalBackend(t *testing.T) {
+	content := make([]byte, 100000)
+	rand.New(rand.NewSource(1)).Read(content)
+	dir := setupLocalProxy(t, "file.bin", content)
+	defer os.RemoveAll(dir)
+
+	w := proxyRequest(t, dir, httptest.NewRequest("GET", "/file.bin", nil))
+	if w.Code != http.StatusOK || bytes.Equal(w.Body.Bytes(), content) == false {
+		t.Fatalf("GET returned %d with %d bytes", w.Code, w.Body.Len())
+	}
+
+	rq := httptest.NewRequest("GET", "/file.bin", nil)
+	rq.Header.Set("Range", "bytes=33000-66999")
+	w = proxyRequest(t, dir, rq)
+	if w.Code != http.StatusPartialContent || bytes.Equal(w.Body.Bytes(), content[33000:67000]) == false {
+		t.Fatalf("ranged GET returned %d with %d bytes", w.Code, w.Body.Len())
+	}
+}
+
+func TestProxyLocalBackendOutsideRoot(t *testing.T) {
+	content := []byte("this must not be served from outside of the allowed directories")
+	dir := setupLocalProxy(t, "file.bin", content)
+	defer os.RemoveAll(dir)
+
+	// Move the blobs to a directory which was never allowed
+	aliasPath := filepath.Join(dir, "_aliases", "file.bin")
+	meta, err := uploadtool.ReadMeta(aliasPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(dir, "blobs"), filepath.Join(dir, "elsewhere")); err != nil {
+		t.Fatal(err)
+	}
+	for i, location := range meta.Location[0] {
+		meta.Location[0][i] = strings.Replace(location, "/blobs/", "/elsewhere/", 1)
+	}
+	if err := uploadtool.WriteMeta(aliasPath, meta); err != nil {
+		t.Fatal(err)
+	}
+
+	w := proxyRequest(t, dir, httptest.NewRequest("GET", "/file.bin", nil))
+	if bytes.Contains(w.Body.Bytes(), content[:10]) {
+		t.Fatalf("served a blob outside of the allowed directories")
+	}
+}
+
+func TestProxyEmptyPut(t *testing.T) {
+	dir := setupLocalProxy(t, "file.bin", []byte("some content"))
+	defer os.RemoveAll(dir)
+
+	be, err := backend.ForTarget("file://" + filepath.ToSlash(filepath.Join(dir, "blobs")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploadTool = uploadtool.New(be)
+	defer func() { uploadTool = nil }()
+
+	w := proxyRequest(t, dir, httptest.NewRequest("PUT", "/empty.bin", bytes.NewReader(nil)))
+	if w.Code >= 300 {
+		t.Fatalf("PUT of an empty file returned %d", w.Code)
+	}
+
+	// Empty content is stored as a replica without any parts
+	meta, err := uploadtool.ReadMeta(filepath.Join(dir, "_aliases", "empty.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.ContentSize != 0 || len(meta.Location) != 1 || len(meta.Location[0]) != 0 {
+		t.Fatalf("unexpected metadata of an empty file: %+v", meta)
+	}
+
+	w = proxyRequest(t, dir, httptest.NewRequest("GET", "/empty.bin", nil))
+	if w.Code != http.StatusOK || w.Body.Len() != 0 || w.Header().Get("Content-Length") != "0" {
+		t.Fatalf("GET of an empty file returned %d with %d bytes", w.Code, w.Body.Len())
+	}
+
+	rq := httptest.NewRequest("GET", "/empty.bin", nil)
+	rq.Header.Set("Range", "bytes=0-")
+	w = proxyRequest(t, dir, rq)
+	if w.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Fatalf("ranged GET of an empty file returned %d", w.Code)
+	}
+}
@@ -0,0 +1,200 @@
+/*
+ * Copyright (C) 2015 Adrian Ulrich <adrian@blinkenlights.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package hgmweb
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var reRangeSpec = regexp.MustCompile("^([0-9]*)-([0-9]*)$")
+
+var errInvalidRange = errors.New("Invalid range header")
+var errUnsatisfiableRange = errors.New("Requested range not satisfiable")
+
+/* Requests with more ranges are answered with the whole file */
+const maxRanges = 16
+
+/* A range of bytes requested by the client, see RFC 7233 */
+type byteRange struct {
+	start  int64
+	length int64
+}
+
+/**
+ * Parses the value of a Range header for a file with size bytes
+ * Returns nil if the header is empty, errInvalidRange if the header shall be ignored
+ * and errUnsatisfiableRange if none of the ranges overlaps with the file
+ * The returned ranges are sorted, overlapping and adjacent ranges are merged
+ */
+func parseRange(header string, size int64) ([]byteRange, error) {
+	if header == "" {
+		return nil, nil
+	}
+	if strings.HasPrefix(header, "bytes=") == false {
+		return nil, errInvalidRange
+	}
+
+	ranges := make([]byteRange, 0)
+	total := int64(0)
+	for _, spec := range strings.Split(header[len("bytes="):], ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+
+		matches := reRangeSpec.FindStringSubmatch(spec) /* [0]=text, [1]=first, [2]=last */
+		if len(matches) != 3 || (matches[1] == "" && matches[2] == "") {
+			return nil, errInvalidRange
+		}
+
+		var rng byteRange
+		if matches[1] == "" {
+			/* suffix range: the last N bytes */
+			n, err := strconv.ParseInt(matches[2], 10, 64)
+			if err != nil {
+				return nil, errInvalidRange
+			}
+			if n > size {
+				n = size
+			}
+			rng = byteRange{start: size - n, length: n}
+		} else {
+			first, err := strconv.ParseInt(matches[1], 10, 64)
+			if err != nil {
+				return nil, errInvalidRange
+			}
+			last := size - 1
+			if matches[2] != "" {
+				last, err = strconv.ParseInt(matches[2], 10, 64)
+				if err != nil || last < first {
+					return nil, errInvalidRange
+				}
+				if last >= size {
+					last = size - 1
+				}
+			}
+			rng = byteRange{start: first, length: last - first + 1}
+		}
+
+		if rng.start < size && rng.length > 0 {
+			ranges = append(ranges, rng)
+			total += rng.length
+		}
+		if len(ranges) > maxRanges {
+			return nil, errInvalidRange
+		}
+	}
+
+	if len(ranges) == 0 {
+		return nil, errUnsatisfiableRange
+	}
+	if total > size {
+		/* clients asking for more than the whole file get the whole file */
+		return nil, errInvalidRange
+	}
+	return mergeRanges(ranges), nil
+}
+
+/* Sorts ranges by their start and merges overlapping or adjacent ones */
+func mergeRanges(ranges []byteRange) []byteRange {
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start < ranges[j].start })
+
+	merged := ranges[:1]
+	for _, rng := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if rng.start <= last.start+last.length {
+			if end := rng.start + rng.length; end > last.start+last.length {
+				last.length = end - last.start
+			}
+			continue
+		}
+		merged = append(merged, rng)
+	}
+	return merged
+}
+
+/**
+ * Returns true if the client may get a partial response, which is the case
+ * if the client has the current version of the file (see If-Range in RFC 7233)
+ */
+func ifRangeMatches(r *http.Request, etag string, lastModified time.Time) bool {
+	ifRange := r.Header.Get("If-Range")
+	if ifRange == "" {
+		return true
+	}
+	if clientLM, err := http.ParseTime(ifRange); err == nil {
+		return clientLM.Unix() == lastModified.Unix()
+	}
+	return ifRange == etag /* requires a strong match */
+}
+
+/* Passes at most remain bytes to w */
+type rangeWriter struct {
+	w      io.Writer
+	remain int64
+	err    error /* last error returned by w: the client went away */
+}
+
+func (rw *rangeWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) <= rw.remain {
+		n, err := rw.w.Write(p)
+		rw.remain -= int64(n)
+		if err != nil {
+			rw.err = err
+		}
+		return n, err
+	}
+	n, err := rw.w.Write(p[:rw.remain])
+	rw.remain -= int64(n)
+	if err != nil {
+		rw.err = err
+	} else {
+		err = io.ErrShortWrite /* we are done, callers check remain */
+	}
+	return n, err
+}
+
+/* Sends the HTTP header once the first byte of the body is written */
+type lazyHeaderWriter struct {
+	w      http.ResponseWriter
+	status int
+	sent   bool
+}
+
+func (lw *lazyHeaderWriter) Write(p []byte) (int, error) {
+	if lw.sent == false {
+		lw.sent = true
+		lw.w.WriteHeader(lw.status)
+	}
+	return lw.w.Write(p)
+}
+
+/* Counts the bytes written to it */
+type countingWriter int64
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	*cw += countingWriter(len(p))
+	return len(p), nil
+}
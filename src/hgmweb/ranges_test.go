@@ -0,0 +1,158 @@
+/*
+ * Copyright (C) 2015 Adrian Ulrich <adrian@blinkenlights.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package hgmweb
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		header string
+		want   []byteRange
+		err    error
+	}{
+		{"", nil, nil},
+		{"bytes=0-9", []byteRange{{0, 10}}, nil},
+		{"bytes=10-19", []byteRange{{10, 10}}, nil},
+		{"bytes=90-200", []byteRange{{90, 10}}, nil},
+		{"bytes=-5", []byteRange{{95, 5}}, nil},
+		{"bytes=-500", []byteRange{{0, 100}}, nil},
+		{"bytes=95-", []byteRange{{95, 5}}, nil},
+		{"bytes=0-0,-1", []byteRange{{0, 1}, {99, 1}}, nil},
+		{"bytes=50-59, 0-9", []byteRange{{0, 10}, {50, 10}}, nil},
+		{"bytes=0-9,10-19", []byteRange{{0, 20}}, nil},
+		{"bytes=0-9,5-14,30-39", []byteRange{{0, 15}, {30, 10}}, nil},
+		{"bytes=20-29,22-25", []byteRange{{20, 10}}, nil},
+		{"bytes=100-", nil, errUnsatisfiableRange},
+		{"bytes=200-300", nil, errUnsatisfiableRange},
+		{"bytes=-0", nil, errUnsatisfiableRange},
+		{"bytes=9-0", nil, errInvalidRange},
+		{"bytes=a-b", nil, errInvalidRange},
+		{"bytes=-", nil, errInvalidRange},
+		{"items=0-9", nil, errInvalidRange},
+		{"bytes=0-59,40-99", nil, errInvalidRange},
+		{"bytes=0-1,2-3,4-5,6-7,8-9,10-11,12-13,14-15,16-17,18-19,20-21,22-23,24-25,26-27,28-29,30-31,32-33", nil, errInvalidRange},
+	}
+
+	for _, tt := range tests {
+		got, err := parseRange(tt.header, 100)
+		if err != tt.err {
+			t.Errorf("%q: got error %v, want %v", tt.header, err, tt.err)
+			continue
+		}
+		if reflect.DeepEqual(got, tt.want) == false {
+			t.Errorf("%q: got %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestIfRangeMatches(t *testing.T) {
+	etag := `"abc"`
+	lastModified := time.Unix(1500000000, 0)
+
+	tests := []struct {
+		ifRange string
+		want    bool
+	}{
+		{"", true},
+		{`"abc"`, true},
+		{`"def"`, false},
+		{`W/"abc"`, false},
+		{lastModified.UTC().Format(http.TimeFormat), true},
+		{lastModified.Add(time.Hour).UTC().Format(http.TimeFormat), false},
+	}
+
+	for _, tt := range tests {
+		r, _ := http.NewRequest("GET", "/", nil)
+		if tt.ifRange != "" {
+			r.Header.Set("If-Range", tt.ifRange)
+		}
+		if got := ifRangeMatches(r, etag, lastModified); got != tt.want {
+			t.Errorf("If-Range %q: got %v, want %v", tt.ifRange, got, tt.want)
+		}
+	}
+}
+
+func TestProxyRanges(t *testing.T) {
+	content := make([]byte, 1000)
+	rand.New(rand.NewSource(1)).Read(content)
+	dir := setupLocalProxy(t, "file.bin", content)
+	defer os.RemoveAll(dir)
+
+	get := func(rangeHeader string) *httptest.ResponseRecorder {
+		rq := httptest.NewRequest("GET", "/file.bin", nil)
+		rq.Header.Set("Range", rangeHeader)
+		return proxyRequest(t, dir, rq)
+	}
+
+	w := get("bytes=1000-")
+	if w.Code != http.StatusRequestedRangeNotSatisfiable || w.Header().Get("Content-Range") != "bytes */1000" {
+		t.Fatalf("unsatisfiable range returned %d, Content-Range %q", w.Code, w.Header().Get("Content-Range"))
+	}
+
+	w = get("bytes=900-,0-9,5-19")
+	mediaType, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if w.Code != http.StatusPartialContent || err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("multiple ranges returned %d, Content-Type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	want := []struct {
+		contentRange string
+		body         []byte
+	}{
+		{"bytes 0-19/1000", content[0:20]},
+		{"bytes 900-999/1000", content[900:]},
+	}
+	mr := multipart.NewReader(w.Body, params["boundary"])
+	for i, part := range want {
+		p, err := mr.NextPart()
+		if err != nil {
+			t.Fatalf("part %d: %s", i, err)
+		}
+		body, _ := ioutil.ReadAll(p)
+		if p.Header.Get("Content-Range") != part.contentRange || bytes.Equal(body, part.body) == false {
+			t.Fatalf("part %d: got %q with %d bytes", i, p.Header.Get("Content-Range"), len(body))
+		}
+	}
+	if _, err := mr.NextPart(); err == nil {
+		t.Fatalf("got more parts than expected")
+	}
+
+	many := make([]string, maxRanges+1)
+	for i := range many {
+		many[i] = strconv.Itoa(i*10) + "-" + strconv.Itoa(i*10+1)
+	}
+	for _, header := range []string{"bytes=" + strings.Join(many, ","), "bytes=0-599,400-999"} {
+		w = get(header)
+		if w.Code != http.StatusOK || bytes.Equal(w.Body.Bytes(), content) == false {
+			t.Fatalf("%q returned %d with %d bytes", header, w.Code, w.Body.Len())
+		}
+	}
+}
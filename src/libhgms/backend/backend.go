@@ -0,0 +1,94 @@
+/*
+ * Copyright (C) 2015 Adrian Ulrich <adrian@blinkenlights.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package backend
+
+import (
+	"errors"
+	"io"
+	"libhgms/flickr/png"
+	"net/url"
+	"os"
+)
+
+var ErrNotSupported = errors.New("Operation not supported by this backend")
+var ErrUnknownScheme = errors.New("No backend for this location")
+var ErrOutsideRoot = errors.New("Location is outside of the allowed local directories")
+
+// A storage backend holding our PNG blobs. Blobs are identified by their location,
+// an URL whose scheme selects the backend (see ForLocation)
+type Backend interface {
+	// Stores size bytes read from r as a new blob and returns its location
+	Put(r io.Reader, size int64) (string, error)
+	// Returns the content of the blob at location, starting at offset.
+	// A negative length returns everything up to the end of the blob
+	Get(location string, offset int64, length int64) (io.ReadCloser, error)
+	// Removes the blob at location
+	Delete(location string) error
+	// Returns the size of the blob at location
+	Stat(location string) (int64, error)
+}
+
+var httpDefault = newHttpBackend()
+var localDefault = &localBackend{root: ""} // read-only, limited to the directories allowed by AllowLocalRoot
+
+// Returns the backend responsible for the given blob location
+func ForLocation(location string) (Backend, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return httpDefault, nil
+	case "file":
+		return localDefault, nil
+	}
+	return nil, ErrUnknownScheme
+}
+
+// Returns a backend which stores new blobs at target. Supported targets are
+// 'flickr' (configured via ~/.flickrrc) and local directories such as file:///some/dir
+func ForTarget(target string) (Backend, error) {
+	if target == "flickr" {
+		uploader, err := flickr.NewUploader(os.Getenv("HOME") + "/.flickrrc")
+		if err != nil {
+			return nil, err
+		}
+		return &flickrBackend{httpBackend: httpDefault, uploader: uploader}, nil
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "file" {
+		return newLocalBackend(u.Path)
+	}
+	return nil, ErrUnknownScheme
+}
+
+// Flickr only offers uploads, everything else is done via plain http
+type flickrBackend struct {
+	*httpBackend
+	uploader *flickr.Uploader
+}
+
+func (be *flickrBackend) Put(r io.Reader, size int64) (string, error) {
+	return be.uploader.Upload(r, size)
+}
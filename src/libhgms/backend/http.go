@@ -0,0 +1,121 @@
+/*
+ * Copyright (C) 2015 Adrian Ulrich <adrian@blinkenlights.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package backend
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Read-only backend for blobs served by any http server (such as flickr)
+type httpBackend struct {
+	client *http.Client
+}
+
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func newHttpBackend() *httpBackend {
+	tr := &http.Transport{ResponseHeaderTimeout: 5 * time.Second, Proxy: http.ProxyFromEnvironment}
+	return &httpBackend{client: &http.Client{Transport: tr}}
+}
+
+func (be *httpBackend) Put(r io.Reader, size int64) (string, error) {
+	return "", ErrNotSupported
+}
+
+func (be *httpBackend) Delete(location string) error {
+	return ErrNotSupported
+}
+
+func (be *httpBackend) Get(location string, offset int64, length int64) (io.ReadCloser, error) {
+	rq, err := http.NewRequest("GET", location, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if length >= 0 {
+		rq.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	} else if offset > 0 {
+		rq.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := be.client.Do(rq)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		// server honored our range request: make sure it starts where we asked it to
+		if start, ok := contentRangeStart(resp.Header.Get("Content-Range")); ok == false || start != offset {
+			resp.Body.Close()
+			return nil, fmt.Errorf("%s returned Content-Range '%s' for offset %d", location, resp.Header.Get("Content-Range"), offset)
+		}
+	case http.StatusOK:
+		// got the full blob: skip to the requested offset ourselves
+		if offset > 0 {
+			_, err = io.CopyN(ioutil.Discard, resp.Body, offset)
+			if err != nil {
+				resp.Body.Close()
+				return nil, err
+			}
+		}
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s returned HTTP status %d", location, resp.StatusCode)
+	}
+
+	if length >= 0 {
+		return &limitedReadCloser{Reader: io.LimitReader(resp.Body, length), Closer: resp.Body}, nil
+	}
+	return resp.Body, nil
+}
+
+// Returns the first byte of a 'bytes first-last/size' Content-Range header
+func contentRangeStart(contentRange string) (int64, bool) {
+	if strings.HasPrefix(contentRange, "bytes ") == false {
+		return 0, false
+	}
+	dash := strings.IndexByte(contentRange, '-')
+	if dash < 0 {
+		return 0, false
+	}
+	start, err := strconv.ParseInt(contentRange[len("bytes "):dash], 10, 64)
+	return start, err == nil
+}
+
+func (be *httpBackend) Stat(location string) (int64, error) {
+	resp, err := be.client.Head(location)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("%s returned HTTP status %d", location, resp.StatusCode)
+	}
+	return resp.ContentLength, nil
+}
@@ -0,0 +1,85 @@
+/*
+ * Copyright (C) 2015 Adrian Ulrich <adrian@blinkenlights.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package backend
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHttpBackendRanges(t *testing.T) {
+	content := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	var contentRange string // sent instead of the real Content-Range if set, "-" omits it
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/full"):
+			w.Write(content) // ignores the range
+		case contentRange != "":
+			if contentRange != "-" {
+				w.Header().Set("Content-Range", contentRange)
+			}
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(content)
+		default:
+			http.ServeContent(w, r, "blob", time.Time{}, bytes.NewReader(content))
+		}
+	}))
+	defer srv.Close()
+	be := newHttpBackend()
+
+	for _, path := range []string{"/blob", "/full"} {
+		for _, offset := range []int64{0, 10} {
+			for _, length := range []int64{-1, 5} {
+				want := content[offset:]
+				if length >= 0 {
+					want = want[:length]
+				}
+				r, err := be.Get(srv.URL+path, offset, length)
+				if err != nil {
+					t.Fatalf("%s at %d+%d: %s", path, offset, length, err)
+				}
+				got, err := ioutil.ReadAll(r)
+				r.Close()
+				if err != nil || bytes.Equal(got, want) == false {
+					t.Fatalf("%s at %d+%d: got %q, %v", path, offset, length, got, err)
+				}
+			}
+		}
+	}
+
+	// A partial response must start at the requested offset
+	for _, contentRange = range []string{"-", "bytes 0-35/36", "bytes 11-35/36", "bytes */36", "items 10-35/36"} {
+		if r, err := be.Get(srv.URL+"/blob", 10, -1); err == nil {
+			r.Close()
+			t.Errorf("Content-Range %q was accepted for offset 10", contentRange)
+		}
+	}
+	contentRange = fmt.Sprintf("bytes 10-35/%d", len(content))
+	r, err := be.Get(srv.URL+"/blob", 10, -1)
+	if err != nil {
+		t.Fatalf("matching Content-Range was rejected: %s", err)
+	}
+	r.Close()
+}
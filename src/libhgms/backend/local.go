@@ -0,0 +1,193 @@
+/*
+ * Copyright (C) 2015 Adrian Ulrich <adrian@blinkenlights.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package backend
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Directories which may be accessed via file:// locations, see AllowLocalRoot
+var localRoots = struct {
+	sync.RWMutex
+	dirs []string
+}{}
+
+// Stores blobs as files in a local directory (which may also be a NAS mount)
+type localBackend struct {
+	root string // directory receiving new blobs, empty if this backend is read-only
+}
+
+// Returns a new local backend storing blobs at dir. The directory is created if needed
+func newLocalBackend(dir string) (*localBackend, error) {
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(root, 0755)
+	if err != nil {
+		return nil, err
+	}
+	err = AllowLocalRoot(root) // we must be able to read what we stored
+	if err != nil {
+		return nil, err
+	}
+	return &localBackend{root: root}, nil
+}
+
+// Allows access to blobs stored below dir via file:// locations.
+// Locations outside of all allowed directories are rejected with ErrOutsideRoot
+func AllowLocalRoot(dir string) error {
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	if resolved, err := filepath.EvalSymlinks(root); err == nil {
+		root = resolved
+	}
+
+	localRoots.Lock()
+	defer localRoots.Unlock()
+	localRoots.dirs = append(localRoots.dirs, root)
+	return nil
+}
+
+// Returns true if path is located below one of the allowed directories
+func insideLocalRoot(path string) bool {
+	localRoots.RLock()
+	defer localRoots.RUnlock()
+	for _, root := range localRoots.dirs {
+		if path == root || strings.HasPrefix(path, strings.TrimSuffix(root, string(filepath.Separator))+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (be *localBackend) Put(r io.Reader, size int64) (string, error) {
+	if be.root == "" {
+		return "", ErrNotSupported
+	}
+
+	rnd := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, rnd); err != nil {
+		return "", err
+	}
+
+	// Blobs are spread across 256 subdirectories to keep the directories small
+	name := hex.EncodeToString(rnd)
+	path := filepath.Join(be.root, name[0:2], name+".png")
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return "", err
+	}
+
+	fh, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return "", err
+	}
+
+	nw, err := io.Copy(fh, r)
+	if cerr := fh.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && nw != size {
+		err = io.ErrShortWrite
+	}
+	if err != nil {
+		os.Remove(path)
+		return "", err
+	}
+
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String(), nil
+}
+
+func (be *localBackend) Get(location string, offset int64, length int64) (io.ReadCloser, error) {
+	path, err := localPath(location)
+	if err != nil {
+		return nil, err
+	}
+
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if offset > 0 {
+		_, err = fh.Seek(offset, 0)
+		if err != nil {
+			fh.Close()
+			return nil, err
+		}
+	}
+
+	if length >= 0 {
+		return &limitedReadCloser{Reader: io.LimitReader(fh, length), Closer: fh}, nil
+	}
+	return fh, nil
+}
+
+func (be *localBackend) Delete(location string) error {
+	path, err := localPath(location)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+func (be *localBackend) Stat(location string) (int64, error) {
+	path, err := localPath(location)
+	if err != nil {
+		return 0, err
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// Returns the filesystem path of a file:// location, which must be inside of an allowed directory
+func localPath(location string) (string, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "file" || u.Path == "" {
+		return "", ErrUnknownScheme
+	}
+
+	path := filepath.Clean(filepath.FromSlash(u.Path))
+	if filepath.IsAbs(path) == false {
+		return "", ErrOutsideRoot
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved // symlinks must not point elsewhere
+	}
+	if insideLocalRoot(path) == false {
+		return "", ErrOutsideRoot
+	}
+	return path, nil
+}
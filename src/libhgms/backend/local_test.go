@@ -0,0 +1,115 @@
+/*
+ * Copyright (C) 2015 Adrian Ulrich <adrian@blinkenlights.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package backend
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hgms-backend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	be, err := ForTarget("file://" + filepath.ToSlash(filepath.Join(dir, "blobs")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blob := []byte("0123456789abcdef")
+	location, err := be.Put(bytes.NewReader(blob), int64(len(blob)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := ForLocation(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size, err := reader.Stat(location); err != nil || size != int64(len(blob)) {
+		t.Fatalf("Stat returned %d, %v", size, err)
+	}
+
+	rc, err := reader.Get(location, 4, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil || string(part) != "456789" {
+		t.Fatalf("Get returned %q, %v", part, err)
+	}
+
+	if err := reader.Delete(location); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reader.Stat(location); os.IsNotExist(err) == false {
+		t.Fatalf("blob still exists after Delete: %v", err)
+	}
+}
+
+func TestLocalBackendOutsideRoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hgms-backend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, "root")
+	outside := filepath.Join(dir, "outside.png")
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(outside, []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "link.png")); err != nil {
+		t.Fatal(err)
+	}
+	if err := AllowLocalRoot(root); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{outside, filepath.Join(root, "..", "outside.png"), filepath.Join(root, "link.png"), root + "x/blob.png"} {
+		location := (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+		be, err := ForLocation(location)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rc, err := be.Get(location, 0, -1); err != ErrOutsideRoot {
+			if rc != nil {
+				rc.Close()
+			}
+			t.Errorf("%s: expected ErrOutsideRoot, got %v", location, err)
+		}
+		if err := be.Delete(location); err != ErrOutsideRoot {
+			t.Errorf("%s: Delete returned %v", location, err)
+		}
+	}
+
+	if _, err := os.Stat(outside); err != nil {
+		t.Fatalf("file outside of the root was touched: %v", err)
+	}
+}
@@ -18,35 +18,79 @@
 package aestool
 
 import (
-	"github.com/spacemonkeygo/openssl"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
 	"io"
 )
 
+const (
+	VERSION_CBC = 1 // aes-256-cbc without any authentication, used by old blobs
+	VERSION_GCM = 2 // aes-256-gcm, every GCM_CHUNK_SIZE bytes carry their own authentication tag
+)
+
+const GCM_CHUNK_SIZE = 64 * 1024
+const gcmTagSize = 16
+const gcmNonceSize = 12
+
+var ErrAuthFailed = errors.New("Authentication failed: encrypted data was modified")
+var ErrUnknownVersion = errors.New("Unknown encryption format version")
+
+// De- or encrypts a stream of blocks, partial blocks may be held back until more data arrives
+type blockCrypter interface {
+	Update(in []byte) ([]byte, error)
+}
+
+// Creates the contexts used by VERSION_CBC. The default uses Go's crypto/aes,
+// OpenSSL is used if the binary was built with '-tags openssl'.
+// All providers must produce the same output
+type cipherProvider interface {
+	newCbc(key []byte, iv []byte) (encrypter blockCrypter, decrypter blockCrypter, err error)
+}
+
+var cbcProvider cipherProvider = goProvider{}
+
 type AesTool struct {
-	encrypter openssl.EncryptionCipherCtx
-	decrypter openssl.DecryptionCipherCtx
+	encrypter blockCrypter
+	decrypter blockCrypter
+	aead      cipher.AEAD // only set for VERSION_GCM
+	key       []byte
+	iv        []byte
+	version   int
 	blockSize int
 	streamLen int64
 	skipBytes int64
+	ivFromSrc bool   // CBC: the first block of the stream is the IV (set by SetOffset)
+	gcmChunk  uint32 // GCM: index of the first chunk in the stream (set by SetOffset)
+	blobIndex uint32 // GCM: position of the blob in its file (set by SetBlob)
+	fileSize  int64  // GCM: content size of the whole file (set by SetBlob)
 }
 
 // Returns a new aestool instance. The streamlen parameter specifies
 // how many bites we are going to decrypt (the real filesize is unknown
 // to the decryptor due to padding)
+// This is a shortcut to NewVersion using VERSION_CBC
 func New(streamLen int64, key []byte, iv []byte) (*AesTool, error) {
-	aesTool := AesTool{}
+	return NewVersion(VERSION_CBC, streamLen, key, iv)
+}
 
-	aesCipher, err := openssl.GetCipherByName(GetCipherName())
-	if err != nil {
-		return nil, err
+// Returns a new aestool instance using the given blob format version.
+// A version of 0 refers to the default of unversioned blobs (VERSION_CBC)
+func NewVersion(version int, streamLen int64, key []byte, iv []byte) (*AesTool, error) {
+	if version == 0 {
+		version = VERSION_CBC
 	}
 
-	eCtx, err := openssl.NewEncryptionCipherCtx(aesCipher, nil, key, iv)
-	if err != nil {
-		return nil, err
+	if version == VERSION_GCM {
+		return newGcm(streamLen, key, iv)
+	} else if version != VERSION_CBC {
+		return nil, ErrUnknownVersion
 	}
 
-	dCtx, err := openssl.NewDecryptionCipherCtx(aesCipher, nil, key, iv)
+	aesTool := AesTool{version: version, key: key, iv: iv}
+
+	eCtx, dCtx, err := cbcProvider.newCbc(key, iv)
 	if err != nil {
 		return nil, err
 	}
@@ -72,6 +116,49 @@ func (self *AesTool) SetSkipBytes(sb int64) {
 	self.skipBytes = sb
 }
 
+// Binds the stream to its position: GCM authenticates the index of the blob and
+// the content size of the file with each chunk, so blobs can not be swapped or
+// moved into another file. Must be set to the same values for en- and decryption
+// This has no effect on VERSION_CBC
+func (self *AesTool) SetBlob(index int, contentSize int64) {
+	self.blobIndex = uint32(index)
+	self.fileSize = contentSize
+}
+
+// Prepares decryption to start at given plaintext offset without decrypting
+// everything before it. Returns the number of bytes the caller must remove from
+// the start of the encrypted stream before calling DecryptStream.
+// CBC streams start one block early as the previous block is the IV of the next one,
+// GCM streams must start at a chunk boundary as each chunk is verified as a whole
+func (self *AesTool) SetOffset(offset int64) (int64, error) {
+	if offset < 0 || (self.streamLen > -1 && offset > self.streamLen) {
+		return 0, errors.New("Offset out of range")
+	}
+
+	var start int64 // first plaintext byte we are going to decrypt
+	var discard int64
+
+	if self.version == VERSION_GCM {
+		chunk := offset / GCM_CHUNK_SIZE
+		start = chunk * GCM_CHUNK_SIZE
+		discard = chunk * (GCM_CHUNK_SIZE + gcmTagSize)
+		self.gcmChunk = uint32(chunk)
+	} else {
+		block := offset / int64(self.blockSize)
+		if block > 0 {
+			start = block * int64(self.blockSize)
+			discard = start - int64(self.blockSize)
+			self.ivFromSrc = true
+		}
+	}
+
+	if self.streamLen > -1 {
+		self.streamLen -= start
+	}
+	self.skipBytes = offset - start
+	return discard, nil
+}
+
 // Handles all decryption and encryption work
 func (self *AesTool) cryptWorker(dst io.Writer, src io.Reader, decrypt bool) (err error) {
 	blockBuf := make([]byte, 1024*512)
@@ -79,6 +166,19 @@ func (self *AesTool) cryptWorker(dst io.Writer, src io.Reader, decrypt bool) (er
 	var ctxt []byte
 	var cerr error
 
+	if decrypt == true && self.ivFromSrc == true {
+		// We were seeked into the stream: start with a fresh context using the preceding block as IV
+		iv := make([]byte, self.blockSize)
+		if _, err := io.ReadFull(src, iv); err != nil {
+			return err
+		}
+		_, self.decrypter, err = cbcProvider.newCbc(self.key, iv)
+		if err != nil {
+			return err
+		}
+		self.ivFromSrc = false
+	}
+
 	for self.streamLen != 0 {
 		wFrom := int64(0)
 		wTo := int64(0)
@@ -89,18 +189,20 @@ func (self *AesTool) cryptWorker(dst io.Writer, src io.Reader, decrypt bool) (er
 			break /* not really an error for us */
 		}
 		if er != nil {
-			panic(er)
+			err = er
+			break
 		}
 
 		// De- or Encrypt the data
 		// We expect to get padded data, so no need to call Finish
 		if decrypt == true {
-			ctxt, cerr = self.decrypter.DecryptUpdate(blockBuf[0:br])
+			ctxt, cerr = self.decrypter.Update(blockBuf[0:br])
 		} else {
-			ctxt, cerr = self.encrypter.EncryptUpdate(blockBuf[0:br])
+			ctxt, cerr = self.encrypter.Update(blockBuf[0:br])
 		}
 		if cerr != nil {
-			panic(cerr)
+			err = cerr
+			break
 		}
 		copy(blockBuf, ctxt)
 		wTo = int64(len(ctxt)) // may be different (IV)
@@ -144,10 +246,157 @@ func (self *AesTool) cryptWorker(dst io.Writer, src io.Reader, decrypt bool) (er
 
 // Decrypts given input stream. This is a shortcut to cryptWorker
 func (self *AesTool) DecryptStream(writer io.Writer, reader io.Reader) error {
+	if self.version == VERSION_GCM {
+		return self.gcmDecrypt(writer, reader)
+	}
 	return self.cryptWorker(writer, reader, true)
 }
 
 // Encrypts given input stream. This is a shortcut to cryptWorker
 func (self *AesTool) EncryptStream(writer io.Writer, reader io.Reader) error {
+	if self.version == VERSION_GCM {
+		return self.gcmEncrypt(writer, reader)
+	}
 	return self.cryptWorker(writer, reader, false)
 }
+
+// Returns a new aestool instance for VERSION_GCM
+func newGcm(streamLen int64, key []byte, iv []byte) (*AesTool, error) {
+	if len(iv) < gcmNonceSize {
+		return nil, errors.New("IV is too short")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	aesTool := &AesTool{
+		aead:      aead,
+		iv:        iv,
+		version:   VERSION_GCM,
+		blockSize: GetCipherBlockSize(),
+		streamLen: streamLen,
+	}
+	return aesTool, nil
+}
+
+// Returns the nonce used by given chunk: the first 96 bits of the IV with the
+// chunk index XORed into the last 4 bytes
+func (self *AesTool) gcmNonce(chunk uint32) []byte {
+	nonce := make([]byte, gcmNonceSize)
+	copy(nonce, self.iv[0:gcmNonceSize])
+	binary.BigEndian.PutUint32(nonce[8:], binary.BigEndian.Uint32(nonce[8:])^chunk)
+	return nonce
+}
+
+// Returns the additional data authenticated with each chunk: the format version,
+// a flag set on the final chunk (to detect truncated streams), the blob index and
+// the content size of the file
+func (self *AesTool) gcmAad(final bool) []byte {
+	aad := make([]byte, 14)
+	aad[0] = byte(self.version)
+	if final {
+		aad[1] = 1
+	}
+	binary.BigEndian.PutUint32(aad[2:6], self.blobIndex)
+	binary.BigEndian.PutUint64(aad[6:14], uint64(self.fileSize))
+	return aad
+}
+
+// Encrypts the reader into GCM_CHUNK_SIZE sized chunks, each followed by its tag
+// The output is padded to a multiple of the block size
+func (self *AesTool) gcmEncrypt(dst io.Writer, src io.Reader) error {
+	cur := make([]byte, GCM_CHUNK_SIZE)
+	next := make([]byte, GCM_CHUNK_SIZE)
+	sealed := make([]byte, 0, GCM_CHUNK_SIZE+gcmTagSize)
+	written := int64(0)
+
+	nc, err := readChunk(src, cur)
+	for chunk := uint32(0); err == nil && nc > 0; chunk++ {
+		// peek at the next chunk as we must know if the current one is the last
+		nn, nerr := readChunk(src, next)
+		if nerr != nil {
+			return nerr
+		}
+
+		sealed = self.aead.Seal(sealed[:0], self.gcmNonce(chunk), cur[:nc], self.gcmAad(nn == 0))
+		nw, ew := dst.Write(sealed)
+		written += int64(nw)
+		if ew != nil {
+			return ew
+		}
+
+		cur, next = next, cur
+		nc = nn
+	}
+	if err != nil {
+		return err
+	}
+
+	if pad := written % int64(self.blockSize); pad != 0 {
+		_, err = dst.Write(make([]byte, int64(self.blockSize)-pad))
+	}
+	return err
+}
+
+// Decrypts and verifies streamLen bytes, nothing is written unless its chunk was verified
+func (self *AesTool) gcmDecrypt(dst io.Writer, src io.Reader) error {
+	if self.streamLen < 0 {
+		return errors.New("GCM decryption requires a known stream length")
+	}
+
+	sealed := make([]byte, GCM_CHUNK_SIZE+gcmTagSize)
+	plain := make([]byte, 0, GCM_CHUNK_SIZE)
+
+	// streamLen includes the bytes to skip: we always start at a chunk boundary
+	for chunk := self.gcmChunk; self.streamLen > 0; chunk++ {
+		clen := int64(GCM_CHUNK_SIZE)
+		if clen > self.streamLen {
+			clen = self.streamLen
+		}
+
+		_, err := io.ReadFull(src, sealed[:clen+gcmTagSize])
+		if err != nil {
+			return err
+		}
+
+		plain, err = self.aead.Open(plain[:0], self.gcmNonce(chunk), sealed[:clen+gcmTagSize], self.gcmAad(clen == self.streamLen))
+		if err != nil {
+			return ErrAuthFailed
+		}
+
+		wFrom := int64(0)
+		if self.skipBytes != 0 {
+			wFrom = self.skipBytes
+			if wFrom > clen {
+				wFrom = clen
+			}
+			self.skipBytes -= wFrom
+		}
+
+		nw, ew := dst.Write(plain[wFrom:])
+		self.streamLen -= wFrom + int64(nw)
+		if ew != nil {
+			return ew
+		}
+		if int64(nw) != clen-wFrom {
+			return io.ErrShortWrite
+		}
+	}
+	return nil
+}
+
+// Fills buf from src, returns a short count only at the end of the stream
+func readChunk(src io.Reader, buf []byte) (int, error) {
+	n, err := io.ReadFull(src, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return n, err
+}
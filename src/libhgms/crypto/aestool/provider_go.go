@@ -0,0 +1,62 @@
+/*
+ * Copyright (C) 2015 Adrian Ulrich <adrian@blinkenlights.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package aestool
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+)
+
+// The default provider, implemented using Go's crypto/aes
+type goProvider struct{}
+
+// A CBC context which keeps partial blocks until more data arrives (just like OpenSSL)
+// Decrypting contexts also hold back the last full block, as OpenSSL's DecryptUpdate
+// does with padding enabled
+type goCbc struct {
+	mode     cipher.BlockMode
+	pending  []byte
+	holdBack bool
+}
+
+func (p goProvider) newCbc(key []byte, iv []byte) (blockCrypter, blockCrypter, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(iv) != block.BlockSize() {
+		return nil, nil, errors.New("IV size does not match the block size")
+	}
+	encrypter := &goCbc{mode: cipher.NewCBCEncrypter(block, iv)}
+	decrypter := &goCbc{mode: cipher.NewCBCDecrypter(block, iv), holdBack: true}
+	return encrypter, decrypter, nil
+}
+
+func (c *goCbc) Update(in []byte) ([]byte, error) {
+	buf := append(c.pending, in...)
+	n := len(buf) - len(buf)%c.mode.BlockSize()
+	if c.holdBack && n > 0 && n == len(buf) {
+		n -= c.mode.BlockSize()
+	}
+
+	out := make([]byte, n)
+	c.mode.CryptBlocks(out, buf[:n])
+	c.pending = append([]byte(nil), buf[n:]...)
+	return out, nil
+}
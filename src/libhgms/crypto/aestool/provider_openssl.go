@@ -0,0 +1,68 @@
+//go:build openssl
+// +build openssl
+
+/*
+ * Copyright (C) 2015 Adrian Ulrich <adrian@blinkenlights.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package aestool
+
+import (
+	"github.com/spacemonkeygo/openssl"
+)
+
+// Uses OpenSSL instead of Go's crypto/aes, enabled by building with '-tags openssl'
+type opensslProvider struct{}
+
+type opensslEncrypter struct {
+	ctx openssl.EncryptionCipherCtx
+}
+
+type opensslDecrypter struct {
+	ctx openssl.DecryptionCipherCtx
+}
+
+func init() {
+	cbcProvider = opensslProvider{}
+}
+
+func (p opensslProvider) newCbc(key []byte, iv []byte) (blockCrypter, blockCrypter, error) {
+	aesCipher, err := openssl.GetCipherByName(GetCipherName())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	eCtx, err := openssl.NewEncryptionCipherCtx(aesCipher, nil, key, iv)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dCtx, err := openssl.NewDecryptionCipherCtx(aesCipher, nil, key, iv)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &opensslEncrypter{ctx: eCtx}, &opensslDecrypter{ctx: dCtx}, nil
+}
+
+func (e *opensslEncrypter) Update(in []byte) ([]byte, error) {
+	return e.ctx.EncryptUpdate(in)
+}
+
+// Note: OpenSSL holds back the last block until it sees more data
+func (d *opensslDecrypter) Update(in []byte) ([]byte, error) {
+	return d.ctx.DecryptUpdate(in)
+}
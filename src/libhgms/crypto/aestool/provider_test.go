@@ -0,0 +1,82 @@
+/*
+ * Copyright (C) 2015 Adrian Ulrich <adrian@blinkenlights.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package aestool
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"math/rand"
+	"testing"
+)
+
+// All providers to compare, the OpenSSL one is added if built with '-tags openssl'
+var testProviders = map[string]cipherProvider{"go": goProvider{}}
+
+// Feeds data to crypter in randomly sized pieces and returns everything it returned
+func feedRandomly(t *testing.T, crypter blockCrypter, data []byte, rnd *rand.Rand) []byte {
+	out := make([]byte, 0, len(data))
+	for len(data) > 0 {
+		n := rnd.Intn(len(data) + 1)
+		res, err := crypter.Update(data[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, res...)
+		data = data[n:]
+	}
+	return out
+}
+
+func TestProvidersMatch(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	key := make([]byte, 32)
+	iv := make([]byte, GetCipherBlockSize())
+	rnd.Read(key)
+	rnd.Read(iv)
+
+	block, _ := aes.NewCipher(key)
+	for _, size := range []int{0, 16, 32, 48, 4096, 4096 + 16, 1024*512 + 32} {
+		plain := make([]byte, size)
+		rnd.Read(plain)
+		want := make([]byte, size)
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(want, plain)
+
+		for name, provider := range testProviders {
+			encrypter, decrypter, err := provider.newCbc(key, iv)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			encrypted := feedRandomly(t, encrypter, plain, rnd)
+			if bytes.Equal(encrypted, want) == false {
+				t.Errorf("%s: encrypting %d bytes returned wrong data", name, size)
+			}
+
+			// The last block is held back as it could carry the padding
+			decrypted := feedRandomly(t, decrypter, encrypted, rnd)
+			held := 0
+			if size > 0 {
+				held = GetCipherBlockSize()
+			}
+			if bytes.Equal(decrypted, plain[:size-held]) == false {
+				t.Errorf("%s: decrypting %d bytes returned %d bytes of wrong data", name, size, len(decrypted))
+			}
+		}
+	}
+}
@@ -18,7 +18,10 @@
 package flickr
 
 import (
+	"bytes"
+	"errors"
 	"io"
+	"io/ioutil"
 	"libhgms/crypto/aestool"
 	"os"
 )
@@ -63,6 +66,97 @@ func CryptAes(key []byte, iv []byte, infile string, outfile string, encrypt bool
 
 }
 
+// Encrypts `blobSize` bytes read from `src` and writes them as PNG image to `dst` using given layout.
+// The image will carry the given version, IV, contentSize and blobSize as metadata.
+// `blobIndex` is the position of the blob in its file
+func EncodeBlob(dst io.Writer, src io.Reader, layout string, version int, key []byte, iv []byte, blobIndex int, contentSize int64, blobSize int64) error {
+	aes, err := aestool.NewVersion(version, -1, key, iv)
+	if err != nil {
+		return err
+	}
+	aes.SetBlob(blobIndex, contentSize)
+
+	var plain io.Reader = io.LimitReader(src, blobSize)
+	if version < aestool.VERSION_GCM {
+		// CBC can only encrypt full blocks
+		plain = newPaddingReader(plain, aestool.GetCipherBlockSize())
+	}
+
+	encrypted := new(bytes.Buffer)
+	err = aes.EncryptStream(encrypted, plain)
+	if err != nil {
+		return err
+	}
+	if version < aestool.VERSION_GCM {
+		// CBC decryptors hold back the last block until they see more data (as it could carry
+		// padding), which is why images created by 'openssl enc' end with an extra padding block.
+		// Add a spare block for the same reason: the image itself only pads to full scanlines
+		encrypted.Write(make([]byte, aestool.GetCipherBlockSize()))
+	}
+
+	pw, err := NewWriter(dst)
+	if err != nil {
+		return err
+	}
+	pw.IV = iv
+	pw.ContentSize = contentSize
+	pw.BlobSize = blobSize
+	pw.Version = version
+	pw.Layout = layout
+
+	return pw.WriteImage(encrypted, int64(encrypted.Len()))
+}
+
+// Decrypts the PNG image read from `src` and writes its content to `dst`, this is the counterpart of EncodeBlob.
+// The image must use the given encryption format version and belong to blob `blobIndex` of a file
+// with `contentSize` bytes. Returns the number of bytes written
+func DecodeBlob(dst io.Writer, src io.Reader, version int, key []byte, blobIndex int, contentSize int64) (int64, error) {
+	if version == 0 {
+		version = aestool.VERSION_CBC
+	}
+
+	pr, err := NewReader(src, aestool.GetCipherBlockSize())
+	if err != nil {
+		return 0, err
+	}
+	err = pr.InitReader()
+	if err != nil {
+		return 0, err
+	}
+	if pr.Version != version {
+		return 0, errors.New("Image uses an unexpected encryption format version")
+	}
+
+	aes, err := aestool.NewVersion(version, pr.BlobSize, key, pr.IV)
+	if err != nil {
+		return 0, err
+	}
+	aes.SetBlob(blobIndex, contentSize)
+
+	cw := &countingWriter{w: dst}
+	err = aes.DecryptStream(cw, pr)
+	if err == nil && cw.count != pr.BlobSize {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil {
+		// read the rest of the image to verify all checksums
+		_, err = io.Copy(ioutil.Discard, pr)
+	}
+	return cw.count, err
+}
+
+// Passes all writes to w and counts the written bytes
+type countingWriter struct {
+	w     io.Writer
+	count int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.count += int64(n)
+	return n, err
+}
+
 // Wrapper around io.Reader - ensures that the *last* read
 // is padded to `padbytes' bytes
 func newPaddingReader(r io.Reader, padbytes int) *paddingReader {
@@ -0,0 +1,135 @@
+/*
+ * Copyright (C) 2015 Adrian Ulrich <adrian@blinkenlights.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package flickr
+
+import (
+	"bytes"
+	"libhgms/crypto/aestool"
+	"math/rand"
+	"testing"
+)
+
+// Blobs of any size must survive a round trip, even if their encrypted data fills the image exactly
+func TestEncodeDecodeBlob(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	key := make([]byte, 32)
+	iv := make([]byte, aestool.GetCipherBlockSize())
+	rnd.Read(key)
+	rnd.Read(iv)
+
+	for _, version := range []int{aestool.VERSION_CBC, aestool.VERSION_GCM} {
+		for size := 1; size < 400; size++ {
+			plain := make([]byte, size)
+			rnd.Read(plain)
+
+			image := new(bytes.Buffer)
+			err := EncodeBlob(image, bytes.NewReader(plain), LAYOUT_ZLIB, version, key, iv, 1, 1000, int64(size))
+			if err != nil {
+				t.Fatalf("version %d, %d bytes: %s", version, size, err)
+			}
+
+			decoded := new(bytes.Buffer)
+			n, err := DecodeBlob(decoded, image, version, key, 1, 1000)
+			if err != nil || n != int64(size) || bytes.Equal(decoded.Bytes(), plain) == false {
+				t.Fatalf("version %d, %d bytes: decoded %d bytes, %v", version, size, n, err)
+			}
+		}
+	}
+}
+
+// Encrypts plain as blob blobIndex of a file with contentSize bytes using GCM, returns the ciphertext
+func gcmEncrypt(t *testing.T, plain []byte, key []byte, iv []byte, blobIndex int, contentSize int64) []byte {
+	aes, err := aestool.NewVersion(aestool.VERSION_GCM, -1, key, iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aes.SetBlob(blobIndex, contentSize)
+	sealed := new(bytes.Buffer)
+	if err := aes.EncryptStream(sealed, bytes.NewReader(plain)); err != nil {
+		t.Fatal(err)
+	}
+	return sealed.Bytes()
+}
+
+// Stores sealed in a valid image claiming to hold blobSize bytes of content
+func gcmImage(t *testing.T, sealed []byte, iv []byte, contentSize int64, blobSize int64) *bytes.Buffer {
+	image := new(bytes.Buffer)
+	pw, err := NewWriter(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pw.IV = iv
+	pw.ContentSize = contentSize
+	pw.BlobSize = blobSize
+	pw.Version = aestool.VERSION_GCM
+	if err := pw.WriteImage(bytes.NewReader(sealed), int64(len(sealed))); err != nil {
+		t.Fatal(err)
+	}
+	return image
+}
+
+// Modified, truncated or misplaced GCM blobs must be rejected
+func TestDecodeBlobTampered(t *testing.T) {
+	const blobSize = 3*aestool.GCM_CHUNK_SIZE - 1000
+	const contentSize = 2 * blobSize
+	rnd := rand.New(rand.NewSource(1))
+	key := make([]byte, 32)
+	rnd.Read(key)
+
+	plain := make([][]byte, 2)
+	ivs := make([][]byte, 2)
+	sealed := make([][]byte, 2)
+	for i := range plain {
+		plain[i] = make([]byte, blobSize)
+		ivs[i] = make([]byte, aestool.GetCipherBlockSize())
+		rnd.Read(plain[i])
+		rnd.Read(ivs[i])
+		sealed[i] = gcmEncrypt(t, plain[i], key, ivs[i], i, contentSize)
+	}
+
+	// the untouched blob decodes fine
+	decoded := new(bytes.Buffer)
+	if _, err := DecodeBlob(decoded, gcmImage(t, sealed[1], ivs[1], contentSize, blobSize), aestool.VERSION_GCM, key, 1, contentSize); err != nil || bytes.Equal(decoded.Bytes(), plain[1]) == false {
+		t.Fatalf("failed to decode an untouched blob: %v", err)
+	}
+
+	flipped := append([]byte(nil), sealed[1]...)
+	flipped[aestool.GCM_CHUNK_SIZE+100] ^= 0x01
+
+	// cut off after the second chunk, the image claims to hold the remaining content only
+	const cutSize = 2 * aestool.GCM_CHUNK_SIZE
+	cut := sealed[1][:2*(aestool.GCM_CHUNK_SIZE+16)] // each chunk carries a 16 byte tag
+
+	tests := []struct {
+		name        string
+		image       *bytes.Buffer
+		blobIndex   int
+		contentSize int64
+	}{
+		{"flipped bit", gcmImage(t, flipped, ivs[1], contentSize, blobSize), 1, contentSize},
+		{"cut off final chunk", gcmImage(t, cut, ivs[1], contentSize, cutSize), 1, contentSize},
+		{"swapped blob", gcmImage(t, sealed[0], ivs[0], contentSize, blobSize), 1, contentSize},
+		{"wrong file size", gcmImage(t, sealed[1], ivs[1], contentSize+1, blobSize), 1, contentSize + 1},
+	}
+	for _, tt := range tests {
+		_, err := DecodeBlob(new(bytes.Buffer), tt.image, aestool.VERSION_GCM, key, tt.blobIndex, tt.contentSize)
+		if err != aestool.ErrAuthFailed {
+			t.Errorf("%s: got %v, expected %v", tt.name, err, aestool.ErrAuthFailed)
+		}
+	}
+}
@@ -20,25 +20,63 @@ package flickr
 import (
 	"bufio"
 	"bytes"
+	"compress/flate"
 	"compress/zlib"
 	"errors"
+	"hash"
+	"hash/crc32"
 	"io"
+	"io/ioutil"
 	"strconv"
 )
 
 var zlibFeed = 4096              // keep at least 4k of uncompressed data
 var readerBuffSize = 1024 * 1024 // pre-read up to 1MB
+var maxTextSize = 4096           // larger tEXt chunks are not ours and get skipped
+var maxImageDimension = 1 << 15  // refuse to allocate scanlines for larger images
+
+var ErrNotSeekable = errors.New("Image data can not be read from an arbitrary offset")
+
+// Returned if the image is not a valid PNG file created by us.
+// All other errors are caused by the underlying reader
+type FormatError string
+
+func (e FormatError) Error() string {
+	return "Invalid PNG image: " + string(e)
+}
 
 type reader struct {
-	r            io.Reader // raw-file reader
-	zr           io.Reader // zlib reader
-	uncompressed []byte    // raw data with scanlines
-	decoded      []byte    // decoded -> scanline-free
-	slSize       int       // scanline length
-	minBytes     int       // Minimal number of bytes the reader should return
-	IV           []byte    // IV used by this image
-	ContentSize  int64     // Content-Size sent in HTTP header
-	BlobSize     int64     // Size of this blob
+	r            io.Reader     // raw-file reader
+	br           *bufio.Reader // buffered reader of the image data
+	zr           io.Reader     // zlib reader
+	uncompressed []byte        // raw data with scanlines
+	decoded      []byte        // decoded -> scanline-free
+	slSize       int           // scanline length
+	height       int           // number of scanlines
+	minBytes     int           // Minimal number of bytes the reader should return
+	IV           []byte        // IV used by this image
+	ContentSize  int64         // Content-Size sent in HTTP header
+	BlobSize     int64         // Size of this blob
+	Version      int           // Version of the encryption format, 1 if the image has none
+	Layout       string        // Layout of the image data, see LAYOUT_STORED
+	idatStart    int64         // file offset of the IDAT payload
+	idatSize     int64         // size of the first IDAT chunk
+	err          error         // sticky error of the zlib reader, io.EOF if all data was read
+}
+
+// Returns the payload of consecutive IDAT chunks and verifies their CRC
+type idatReader struct {
+	r      io.Reader
+	remain int64       // payload bytes left in the current chunk
+	crc    hash.Hash32 // nil if the CRC of the current chunk can not be verified
+	done   bool        // true if the last IDAT chunk was read
+}
+
+// Reads the deflate blocks written by storedWriter
+type storedReader struct {
+	r      io.Reader
+	remain int  // bytes left in the current block
+	final  bool // true if the current block is the last one
 }
 
 // Returns a new PNG Reader.
@@ -51,90 +89,167 @@ func NewReader(r io.Reader, minBytes int) (*reader, error) {
 }
 
 // Initializes the PNG reader: Read the initial PNG magic and seek to the IDAT marker.
-// The function will initialize IV, ContentSize and BlobSize
+// The function will initialize IV, ContentSize, BlobSize and Version.
+// Returns a FormatError if the image is corrupted or was not created by us
 func (pr *reader) InitReader() error {
-	chunk := make([]byte, 8)
-	parseHeader := true
+	magic := make([]byte, 8)
+	pr.Version = 1
+	pr.Layout = LAYOUT_ZLIB
 
 	/* Verify PNG-Header magic */
-	pr.r.Read(chunk)
-	if string(chunk) != "\x89PNG\x0D\x0A\x1A\x0A" {
-		return errors.New("Invalid PNG header magic")
-	}
-
-	for parseHeader {
-		pr.r.Read(chunk) /* size of next chunk */
-		qlen := xunpack(chunk)
-
-		if string(chunk[4:]) != "IDAT" && qlen < 4096 {
-			payload := make([]byte, qlen+4) /* 4 = length of CRC */
-			pr.r.Read(payload)
-
-			/* We read the CRC (to get to the correct position) but we are not using it
-			 * -> Therefore it's ok to throw it away now. FIXME: We should probably check the CRC at some later point */
-			payload = payload[:qlen]
-
-			if string(chunk[4:]) == "IHDR" {
-				scanlineVal := xunpack(payload[0:4])
-				bytesPerPixel := 0
-				if payload[9] == 0x2 {
-					bytesPerPixel = 3
-				} else if payload[9] == 0x6 {
-					bytesPerPixel = 4
-				}
-				pr.slSize = scanlineVal * bytesPerPixel
-			} else if string(chunk[4:]) == "tEXt" {
-				pairs := bytes.SplitN(payload, []byte("="), 2)
-
-				if string(pairs[0]) == "IV" {
-					pr.IV = pairs[1]
-				}
-				if string(pairs[0]) == "CONTENTSIZE" {
-					pr.ContentSize, _ = strconv.ParseInt(string(pairs[1]), 10, 64)
-				}
-				if string(pairs[0]) == "BLOBSIZE" {
-					pr.BlobSize, _ = strconv.ParseInt(string(pairs[1]), 10, 64)
-				}
+	if _, err := io.ReadFull(pr.r, magic); err != nil {
+		return err
+	}
+	if string(magic) != "\x89PNG\x0D\x0A\x1A\x0A" {
+		return FormatError("header magic")
+	}
+	pos := int64(len(magic))
+
+	for {
+		ctype, clen, err := readChunkHeader(pr.r)
+		if err != nil {
+			return err
+		}
+		pos += 8
+
+		if pr.slSize == 0 && ctype != "IHDR" {
+			return FormatError("first chunk is not IHDR")
+		}
+
+		if ctype == "IDAT" {
+			pr.idatStart = pos
+			pr.idatSize = clen
+			break
+		} else if ctype == "IEND" {
+			return FormatError("no image data")
+		}
+
+		var payload []byte
+		if ctype == "IHDR" || (ctype == "tEXt" && clen <= int64(maxTextSize)) {
+			payload = make([]byte, clen)
+			_, err = io.ReadFull(pr.r, payload)
+			if err == nil {
+				err = verifyChunkCRC(pr.r, ctype, payload)
 			}
 		} else {
-			parseHeader = false
+			/* not needed by us: skip it */
+			crc := crc32.NewIEEE()
+			crc.Write([]byte(ctype))
+			_, err = io.CopyN(crc, pr.r, clen)
+			if err == nil {
+				err = verifyCRC(pr.r, crc)
+			}
+		}
+		if err != nil {
+			return unexpectedEOF(err)
 		}
+		pos += clen + 4
 
+		if ctype == "IHDR" {
+			err = pr.parseIHDR(payload)
+		} else if ctype == "tEXt" && payload != nil {
+			err = pr.parseText(payload)
+		}
+		if err != nil {
+			return err
+		}
 	}
 
-	/* scanline size must be > 0 */
-	if pr.slSize < 1 {
-		return errors.New("Invalid scanline size, corrupted or unsupported PNG header")
+	if len(pr.IV) != 16 {
+		return FormatError("missing or invalid IV")
+	}
+	if pr.BlobSize < 1 || pr.BlobSize > int64(pr.slSize)*int64(pr.height) || pr.ContentSize < pr.BlobSize {
+		return FormatError("invalid blob or content size")
 	}
 
 	/* Add zlib reader to our struct */
-	zr, err := zlib.NewReader(bufio.NewReaderSize(pr.r, readerBuffSize))
+	crc := crc32.NewIEEE()
+	crc.Write([]byte("IDAT"))
+	pr.br = bufio.NewReaderSize(&idatReader{r: pr.r, remain: pr.idatSize, crc: crc}, readerBuffSize)
+	zr, err := zlib.NewReader(pr.br)
 	if err != nil {
-		return err
+		return zlibError(err)
 	}
 	pr.zr = zr
 
 	return nil
 }
 
+// Parses the image header, we only support 8 bit RGB(A) images without interlacing
+func (pr *reader) parseIHDR(payload []byte) error {
+	if pr.slSize != 0 || len(payload) != 13 {
+		return FormatError("invalid IHDR chunk")
+	}
+
+	width := xunpack(payload[0:4])
+	height := xunpack(payload[4:8])
+	if width < 1 || height < 1 || width > maxImageDimension || height > maxImageDimension {
+		return FormatError("unsupported image dimensions")
+	}
+
+	bytesPerPixel := 0
+	if payload[9] == 0x2 {
+		bytesPerPixel = 3
+	} else if payload[9] == 0x6 {
+		bytesPerPixel = 4
+	}
+	if payload[8] != 8 || bytesPerPixel == 0 || payload[10] != 0 || payload[11] != 0 || payload[12] != 0 {
+		return FormatError("unsupported color type, bit depth, compression, filter or interlace method")
+	}
+
+	pr.slSize = width * bytesPerPixel
+	pr.height = height
+	return nil
+}
+
+// Parses our KEY=VALUE metadata, other tEXt chunks are ignored
+func (pr *reader) parseText(payload []byte) error {
+	pairs := bytes.SplitN(payload, []byte("="), 2)
+	if len(pairs) != 2 {
+		return nil
+	}
+
+	var err error
+	switch string(pairs[0]) {
+	case "IV":
+		pr.IV = pairs[1]
+	case "CONTENTSIZE":
+		pr.ContentSize, err = strconv.ParseInt(string(pairs[1]), 10, 64)
+	case "BLOBSIZE":
+		pr.BlobSize, err = strconv.ParseInt(string(pairs[1]), 10, 64)
+	case "VERSION":
+		pr.Version, err = strconv.Atoi(string(pairs[1]))
+	case "LAYOUT":
+		pr.Layout = string(pairs[1])
+	}
+	if err != nil {
+		return FormatError("invalid value of " + string(pairs[0]))
+	}
+	return nil
+}
+
 // Our public Read function. Returns the bytes read, err on error.
 func (pr *reader) Read(p []byte) (n int, err error) {
 	ucChunk := make([]byte, zlibFeed)
-	running := true
-	for running {
-		if len(pr.decoded) < zlibFeed {
-			/* Read a compressed chunk */
-			zbread, err := pr.zr.Read(ucChunk[0:])
-			if err != nil {
-				running = false
+	for pr.err == nil && len(pr.decoded) < zlibFeed {
+		/* Read a compressed chunk */
+		zbread, err := pr.zr.Read(ucChunk[0:])
+		if err == io.EOF {
+			// zlib does not need the rest of the image data but we want to verify its CRC
+			if _, derr := io.Copy(ioutil.Discard, pr.br); derr != nil {
+				err = derr
 			}
-			pr.uncompressed = append(pr.uncompressed, ucChunk[0:zbread]...)
-			for len(pr.uncompressed) > pr.slSize {
-				pr.decoded = append(pr.decoded, pr.uncompressed[1:pr.slSize+1]...)
-				pr.uncompressed = pr.uncompressed[pr.slSize+1:]
+		}
+		pr.err = zlibError(err)
+
+		pr.uncompressed = append(pr.uncompressed, ucChunk[0:zbread]...)
+		for len(pr.uncompressed) > pr.slSize {
+			if pr.uncompressed[0] != 0 {
+				pr.err = FormatError("unsupported scanline filter")
+				break
 			}
-		} else {
-			running = false
+			pr.decoded = append(pr.decoded, pr.uncompressed[1:pr.slSize+1]...)
+			pr.uncompressed = pr.uncompressed[pr.slSize+1:]
 		}
 	}
 
@@ -149,7 +264,179 @@ func (pr *reader) Read(p []byte) (n int, err error) {
 		return canCopy, nil
 	}
 
-	return 0, errors.New("Nothing to decode")
+	return 0, pr.err
+}
+
+// Throws away the next n bytes of image data
+func (pr *reader) Skip(n int64) error {
+	_, err := io.CopyN(ioutil.Discard, pr, n)
+	return err
+}
+
+// Returns true if the image data can be read from an arbitrary offset,
+// which is the case for images using LAYOUT_STORED
+func (pr *reader) Seekable() bool {
+	/* the IDAT chunk must have been written by storedWriter */
+	return pr.Layout == LAYOUT_STORED && pr.idatSize == 2+int64(pr.height)*int64(pr.slSize+storedRowOverhead)+4
+}
+
+// Returns the file offset of the scanline holding image data byte pos
+func (pr *reader) SeekOffset(pos int64) (int64, error) {
+	if pr.Seekable() == false {
+		return 0, ErrNotSeekable
+	}
+	if pos < 0 || pos >= int64(pr.slSize)*int64(pr.height) {
+		return 0, errors.New("Offset is outside of the image")
+	}
+	return pr.fileOffset(pos), nil
+}
+
+// Returns the file offset of the scanline holding image data byte pos in LAYOUT_STORED
+func (pr *reader) fileOffset(pos int64) int64 {
+	row := pos / int64(pr.slSize)
+	return pr.idatStart + 2 + row*int64(pr.slSize+storedRowOverhead) /* 2 = zlib header */
+}
+
+// Continues reading at image data byte pos using r, which must start at
+// the file offset returned by SeekOffset(pos)
+func (pr *reader) ResumeAt(r io.Reader, pos int64) error {
+	if pr.Seekable() == false {
+		return ErrNotSeekable
+	}
+
+	// We are starting in the middle of the IDAT chunk, so its CRC can not be verified
+	pr.r = r
+	pr.br = bufio.NewReaderSize(&idatReader{r: r, remain: pr.idatStart + pr.idatSize - pr.fileOffset(pos)}, readerBuffSize)
+	pr.zr = &storedReader{r: pr.br}
+	pr.uncompressed = nil
+	pr.decoded = nil
+	pr.err = nil
+	return pr.Skip(pos % int64(pr.slSize))
+}
+
+// Returns the content of the next block(s), the zlib checksum is not verified
+func (sr *storedReader) Read(p []byte) (int, error) {
+	if sr.remain == 0 {
+		if sr.final {
+			return 0, io.EOF
+		}
+		hdr := make([]byte, 5)
+		if _, err := io.ReadFull(sr.r, hdr); err != nil {
+			return 0, err
+		}
+		if hdr[0]&0x6 != 0 || hdr[1] != ^hdr[3] || hdr[2] != ^hdr[4] {
+			return 0, FormatError("invalid stored deflate block")
+		}
+		sr.final = hdr[0]&1 == 1
+		sr.remain = int(hdr[1]) | int(hdr[2])<<8
+	}
+
+	if len(p) > sr.remain {
+		p = p[:sr.remain]
+	}
+	n, err := sr.r.Read(p)
+	sr.remain -= n
+	if err == io.EOF && (sr.remain > 0 || sr.final == false) {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (ir *idatReader) Read(p []byte) (int, error) {
+	for ir.remain == 0 {
+		if ir.done {
+			return 0, io.EOF
+		}
+		if err := ir.nextChunk(); err != nil {
+			return 0, err
+		}
+	}
+
+	if int64(len(p)) > ir.remain {
+		p = p[:ir.remain]
+	}
+	n, err := ir.r.Read(p)
+	if ir.crc != nil {
+		ir.crc.Write(p[:n])
+	}
+	ir.remain -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF /* the CRC is still missing */
+	}
+	return n, err
+}
+
+// Verifies the CRC of the current chunk and moves on to the next one
+func (ir *idatReader) nextChunk() error {
+	if ir.crc != nil {
+		if err := verifyCRC(ir.r, ir.crc); err != nil {
+			return err
+		}
+	} else if _, err := io.ReadFull(ir.r, make([]byte, 4)); err != nil {
+		return unexpectedEOF(err)
+	}
+
+	ctype, clen, err := readChunkHeader(ir.r)
+	if err != nil {
+		return err
+	}
+	if ctype != "IDAT" {
+		ir.done = true /* all image data was read, we do not care about the rest */
+		return nil
+	}
+
+	ir.remain = clen
+	ir.crc = crc32.NewIEEE()
+	ir.crc.Write([]byte(ctype))
+	return nil
+}
+
+// Returns the type and payload length of the next chunk
+func readChunkHeader(r io.Reader) (string, int64, error) {
+	hdr := make([]byte, 8)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return "", 0, unexpectedEOF(err)
+	}
+	clen := int64(xunpack(hdr[0:4]))
+	if clen > 0x7FFFFFFF {
+		return "", 0, FormatError("invalid chunk length")
+	}
+	return string(hdr[4:8]), clen, nil
+}
+
+// Reads the CRC of a chunk and compares it against the CRC of its type and payload
+func verifyChunkCRC(r io.Reader, ctype string, payload []byte) error {
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(ctype))
+	crc.Write(payload)
+	return verifyCRC(r, crc)
+}
+
+func verifyCRC(r io.Reader, crc hash.Hash32) error {
+	sum := make([]byte, 4)
+	if _, err := io.ReadFull(r, sum); err != nil {
+		return unexpectedEOF(err)
+	}
+	if uint32(xunpack(sum)) != crc.Sum32() {
+		return FormatError("CRC mismatch")
+	}
+	return nil
+}
+
+// Converts errors caused by corrupted image data into a FormatError
+func zlibError(err error) error {
+	if _, ok := err.(flate.CorruptInputError); ok || err == zlib.ErrChecksum || err == zlib.ErrHeader {
+		return FormatError(err.Error())
+	}
+	return err
+}
+
+// The image ends early if we hit EOF while reading a chunk
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
 }
 
 // Unpacks a 32bit integer
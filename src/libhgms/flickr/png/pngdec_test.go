@@ -0,0 +1,189 @@
+/*
+ * Copyright (C) 2015 Adrian Ulrich <adrian@blinkenlights.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package flickr
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// Returns a PNG file consisting of the given chunks
+func writePNG(t *testing.T, chunks []pngChunk) []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString("\x89PNG\x0D\x0A\x1A\x0A")
+	pw, _ := NewWriter(buf)
+	for _, c := range chunks {
+		if err := pw.writeChunk(c.ctype, c.payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// Returns the chunks of a valid image holding 100 bytes, ihdr replaces its header if not nil
+func testChunks(ihdr []byte, text ...string) []pngChunk {
+	if ihdr == nil {
+		ihdr = []byte{0, 0, 0, 6, 0, 0, 0, 6, 8, 2, 0, 0, 0}
+	}
+	chunks := []pngChunk{{"IHDR", ihdr}}
+	for _, kv := range append([]string{"IV=0123456789abcdef", "CONTENTSIZE=100", "BLOBSIZE=100"}, text...) {
+		chunks = append(chunks, pngChunk{"tEXt", []byte(kv)})
+	}
+	idat := new(bytes.Buffer)
+	zw := newStoredWriter(idat, 6)
+	for i := 0; i < 6; i++ {
+		zw.Write(make([]byte, 1+6*3))
+	}
+	zw.Close()
+	return append(chunks, pngChunk{"IDAT", idat.Bytes()}, pngChunk{"IEND", nil})
+}
+
+// Runs InitReader on image and reads all of its data
+func decodePNG(image []byte) (err error) {
+	pr, _ := NewReader(bytes.NewReader(image), 16)
+	if err = pr.InitReader(); err == nil {
+		_, err = io.Copy(ioutil.Discard, pr)
+	}
+	return err
+}
+
+func TestInitReaderValidation(t *testing.T) {
+	valid := writePNG(t, testChunks(nil))
+	if err := decodePNG(valid); err != nil {
+		t.Fatalf("valid image was rejected: %s", err)
+	}
+
+	badCRC := append([]byte(nil), valid...)
+	badCRC[8+8+13] ^= 0x01 // CRC of IHDR
+
+	tests := []struct {
+		name  string
+		image []byte
+	}{
+		{"CRC mismatch", badCRC},
+		{"no header magic", valid[1:]},
+		{"image too large", writePNG(t, testChunks([]byte{0, 1, 0, 0, 0, 0, 0, 6, 8, 2, 0, 0, 0}))},
+		{"empty image", writePNG(t, testChunks([]byte{0, 0, 0, 0, 0, 0, 0, 6, 8, 2, 0, 0, 0}))},
+		{"short IHDR", writePNG(t, testChunks([]byte{0, 0, 0, 6, 0, 0, 0, 6, 8, 2, 0, 0}))},
+		{"16 bit samples", writePNG(t, testChunks([]byte{0, 0, 0, 6, 0, 0, 0, 6, 16, 2, 0, 0, 0}))},
+		{"interlaced", writePNG(t, testChunks([]byte{0, 0, 0, 6, 0, 0, 0, 6, 8, 2, 0, 0, 1}))},
+		{"IHDR not first", writePNG(t, testChunks(nil)[1:])},
+		{"invalid BLOBSIZE", writePNG(t, testChunks(nil, "BLOBSIZE=abc"))},
+		{"BLOBSIZE beyond image", writePNG(t, testChunks(nil, "BLOBSIZE=200", "CONTENTSIZE=200"))},
+		{"short IV", writePNG(t, testChunks(nil, "IV=0123"))},
+		{"no image data", writePNG(t, append(testChunks(nil)[:4], pngChunk{"IEND", nil}))},
+	}
+	for _, tt := range tests {
+		if _, ok := decodePNG(tt.image).(FormatError); ok == false {
+			t.Errorf("%s: got %v, expected a FormatError", tt.name, decodePNG(tt.image))
+		}
+	}
+
+	// tEXt chunks of others are ignored
+	if err := decodePNG(writePNG(t, testChunks(nil, "Comment", "Software=gimp"))); err != nil {
+		t.Errorf("tEXt chunk without our metadata was not ignored: %s", err)
+	}
+
+	// An image ending early is an I/O error, the IEND chunk is never read
+	for _, size := range []int{4, 8 + 4, 8 + 8 + 5, 8 + 8 + 13 + 2, len(valid) - 30, len(valid) - 13} {
+		if err := decodePNG(valid[:size]); err != io.ErrUnexpectedEOF {
+			t.Errorf("image truncated to %d bytes: got %v", size, err)
+		}
+	}
+}
+
+// Broken images must be rejected with an error, no matter where they are broken
+func TestInitReaderCorruption(t *testing.T) {
+	valid := writePNG(t, testChunks(nil, "VERSION=2", "LAYOUT=stored"))
+	for i := 0; i < len(valid)-12; i++ { // the IEND chunk is not read
+		for _, b := range []byte{0x01, 0x80, 0xff} {
+			image := append([]byte(nil), valid...)
+			image[i] ^= b
+			if err := decodePNG(image); err == nil {
+				t.Fatalf("flipping byte %d of the image was not detected", i)
+			}
+		}
+		if err := decodePNG(valid[:i]); err == nil {
+			t.Fatalf("image truncated to %d bytes was accepted", i)
+		}
+	}
+}
+
+// Reading a LAYOUT_STORED image from any offset must return the same data as reading it sequentially
+func TestStoredSeek(t *testing.T) {
+	src := make([]byte, 1050) // 19 scanlines of 57 bytes, the last one holds 24 bytes and padding
+	for i := range src {
+		src[i] = byte(i*7 + i/57)
+	}
+	image := new(bytes.Buffer)
+	pw, _ := NewWriter(image)
+	pw.IV = []byte("0123456789abcdef")
+	pw.ContentSize = int64(len(src))
+	pw.BlobSize = int64(len(src))
+	pw.Layout = LAYOUT_STORED
+	if err := pw.WriteImage(bytes.NewReader(src), int64(len(src))); err != nil {
+		t.Fatal(err)
+	}
+
+	pr, _ := NewReader(bytes.NewReader(image.Bytes()), 1)
+	if err := pr.InitReader(); err != nil {
+		t.Fatal(err)
+	}
+	if pr.Seekable() == false {
+		t.Fatal("stored image is not seekable")
+	}
+	sequential, err := ioutil.ReadAll(pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sequential) != 19*57 || bytes.Equal(sequential[:len(src)], src) == false {
+		t.Fatalf("sequential decode returned %d bytes of wrong data", len(sequential))
+	}
+	for _, b := range sequential[len(src):] {
+		if b != 0 {
+			t.Fatal("last scanline is not padded with zeros")
+		}
+	}
+
+	for _, pos := range []int64{0, 1, 56, 57, 58, 500, 18*57 - 1, 18 * 57, 18*57 + 23, 18*57 + 24, 19*57 - 1} {
+		pr, _ := NewReader(bytes.NewReader(image.Bytes()), 1)
+		if err := pr.InitReader(); err != nil {
+			t.Fatal(err)
+		}
+		off, err := pr.SeekOffset(pos)
+		if err != nil {
+			t.Fatalf("SeekOffset(%d) failed: %s", pos, err)
+		}
+		if err := pr.ResumeAt(bytes.NewReader(image.Bytes()[off:]), pos); err != nil {
+			t.Fatalf("ResumeAt(%d) failed: %s", pos, err)
+		}
+		data, err := ioutil.ReadAll(pr)
+		if err != nil {
+			t.Fatalf("reading from %d failed: %s", pos, err)
+		}
+		if bytes.Equal(data, sequential[pos:]) == false {
+			t.Errorf("reading from %d returned %d bytes of wrong data", pos, len(data))
+		}
+	}
+
+	if _, err := pr.SeekOffset(19 * 57); err == nil {
+		t.Error("seeking beyond the image data succeeded")
+	}
+}
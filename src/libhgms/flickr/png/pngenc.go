@@ -0,0 +1,261 @@
+/*
+ * Copyright (C) 2013-2015 Adrian Ulrich <adrian@blinkenlights.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package flickr
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"hash"
+	"hash/adler32"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"strconv"
+)
+
+var bytesPerPixel = 3 // we are always writing RGB images
+
+const (
+	LAYOUT_ZLIB   = "zlib"   // IDAT is compressed using zlib, the default
+	LAYOUT_STORED = "stored" // IDAT consists of uncompressed deflate blocks, one per scanline
+)
+
+// Overhead of each scanline in LAYOUT_STORED: deflate block header (1), LEN (2), NLEN (2) and filter type (1)
+const storedRowOverhead = 6
+
+type pngChunk struct {
+	ctype   string
+	payload []byte
+}
+
+type writer struct {
+	w           io.Writer // raw-file writer
+	IV          []byte    // IV used by this image
+	ContentSize int64     // Content-Size sent in HTTP header
+	BlobSize    int64     // Size of this blob
+	Version     int       // Version of the encryption format, not stored if <= 1
+	Layout      string    // Layout of the image data, defaults to LAYOUT_ZLIB
+}
+
+// Returns a new PNG Writer.
+// Note: IV, ContentSize and BlobSize should be set before calling WriteImage
+func NewWriter(w io.Writer) (*writer, error) {
+	pw := new(writer)
+	pw.w = w
+	return pw, nil
+}
+
+// Converts srcSize bytes of (encrypted) data from src into a PNG image.
+// The image is square and uses 8 bit RGB pixels; the last scanline is padded with zeros
+func (pw *writer) WriteImage(src io.Reader, srcSize int64) error {
+	if srcSize < 1 {
+		return errors.New("Refusing to create an empty image")
+	}
+
+	sllen := scanlineCount(srcSize)
+	slSize := sllen * bytesPerPixel
+
+	/* IHDR: width, height, bitdepth, colortype, compression, filter, interlace */
+	ihdr := make([]byte, 13)
+	xpack(ihdr[0:4], sllen)
+	xpack(ihdr[4:8], sllen)
+	ihdr[8] = 8
+	ihdr[9] = 0x2
+
+	/* All scanlines are deflated into memory as we need to know the IDAT size */
+	idat := new(bytes.Buffer)
+	var zw io.WriteCloser
+	if pw.Layout == LAYOUT_STORED {
+		zw = newStoredWriter(idat, sllen)
+	} else if pw.Layout == "" || pw.Layout == LAYOUT_ZLIB {
+		zw = zlib.NewWriter(idat)
+	} else {
+		return errors.New("Unknown image layout")
+	}
+	scanline := make([]byte, slSize+1) /* first byte is the filter type (0 = none) */
+	for i := 0; i < sllen; i++ {
+		br, err := io.ReadFull(src, scanline[1:])
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		for j := 1 + br; j < len(scanline); j++ {
+			scanline[j] = 0
+		}
+		if _, err := zw.Write(scanline); err != nil {
+			return err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	if _, err := io.WriteString(pw.w, "\x89PNG\x0D\x0A\x1A\x0A"); err != nil {
+		return err
+	}
+
+	chunks := []pngChunk{
+		{"IHDR", ihdr},
+		{"tEXt", append([]byte("IV="), pw.IV...)},
+		{"tEXt", []byte("CONTENTSIZE=" + strconv.FormatInt(pw.ContentSize, 10))},
+		{"tEXt", []byte("BLOBSIZE=" + strconv.FormatInt(pw.BlobSize, 10))},
+	}
+	if pw.Version > 1 {
+		// version 1 images stay unversioned, so old readers can still decode them
+		chunks = append(chunks, pngChunk{"tEXt", []byte("VERSION=" + strconv.Itoa(pw.Version))})
+	}
+	if pw.Layout == LAYOUT_STORED {
+		// this is a hint for our reader: the image is a valid zlib stream in any case
+		chunks = append(chunks, pngChunk{"tEXt", []byte("LAYOUT=" + LAYOUT_STORED)})
+	}
+	chunks = append(chunks, pngChunk{"IDAT", idat.Bytes()}, pngChunk{"IEND", nil})
+
+	for _, c := range chunks {
+		if err := pw.writeChunk(c.ctype, c.payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Writes a length-prefixed PNG chunk with an appended CRC32 checksum
+func (pw *writer) writeChunk(ctype string, payload []byte) error {
+	hdr := make([]byte, 8)
+	xpack(hdr[0:4], len(payload))
+	copy(hdr[4:], ctype)
+
+	crc := crc32.NewIEEE()
+	crc.Write(hdr[4:])
+	crc.Write(payload)
+	sum := make([]byte, 4)
+	xpack(sum, int(crc.Sum32()))
+
+	for _, b := range [][]byte{hdr, payload, sum} {
+		if _, err := pw.w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Packs the encrypted `infile` into the PNG image `outfile`
+// `contentSize` and `blobSize` are stored as metadata and refer to the unencrypted data
+func PackFile(iv []byte, contentSize int64, blobSize int64, infile string, outfile string) {
+
+	fhIn, err := os.Open(infile)
+	if err != nil {
+		panic(err)
+	}
+	defer fhIn.Close()
+
+	stat, err := fhIn.Stat()
+	if err != nil {
+		panic(err)
+	}
+
+	fhOut, err := os.Create(outfile)
+	if err != nil {
+		panic(err)
+	}
+	defer fhOut.Close()
+
+	pw, err := NewWriter(fhOut)
+	if err != nil {
+		panic(err)
+	}
+	pw.IV = iv
+	pw.ContentSize = contentSize
+	pw.BlobSize = blobSize
+
+	err = pw.WriteImage(fhIn, stat.Size())
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Returns the width (and height) of a square image holding size bytes
+func scanlineCount(size int64) int {
+	pixels := (size + int64(bytesPerPixel) - 1) / int64(bytesPerPixel)
+	sllen := int64(math.Sqrt(float64(pixels)))
+	for sllen*sllen < pixels {
+		sllen++
+	}
+	return int(sllen)
+}
+
+// Writes a zlib stream using one uncompressed deflate block per scanline,
+// so that the position of each scanline is known in advance
+type storedWriter struct {
+	w       io.Writer
+	adler   hash.Hash32
+	blocks  int  // number of blocks still to write
+	started bool // true if the zlib header was written
+}
+
+func newStoredWriter(w io.Writer, blocks int) *storedWriter {
+	return &storedWriter{w: w, adler: adler32.New(), blocks: blocks}
+}
+
+// Writes p as a single block: callers must pass exactly one scanline per call
+func (sw *storedWriter) Write(p []byte) (int, error) {
+	if len(p) > 0xFFFF || sw.blocks < 1 {
+		return 0, errors.New("Scanline does not fit into a stored block")
+	}
+	sw.blocks--
+
+	if sw.started == false {
+		// zlib header: deflate with a 32k window, no dictionary
+		if _, err := sw.w.Write([]byte{0x78, 0x01}); err != nil {
+			return 0, err
+		}
+		sw.started = true
+	}
+
+	hdr := make([]byte, 5)
+	if sw.blocks == 0 {
+		hdr[0] = 1 // BFINAL, BTYPE 00
+	}
+	hdr[1], hdr[2] = byte(len(p)), byte(len(p)>>8)
+	hdr[3], hdr[4] = ^hdr[1], ^hdr[2]
+
+	sw.adler.Write(p)
+	if _, err := sw.w.Write(hdr); err != nil {
+		return 0, err
+	}
+	return sw.w.Write(p)
+}
+
+// Writes the adler32 checksum of the zlib stream
+func (sw *storedWriter) Close() error {
+	if sw.blocks != 0 {
+		return errors.New("Stored stream is incomplete")
+	}
+	sum := make([]byte, 4)
+	xpack(sum, int(sw.adler.Sum32()))
+	_, err := sw.w.Write(sum)
+	return err
+}
+
+// Packs a 32bit integer, this is the counterpart of xunpack
+func xpack(b []byte, v int) {
+	b[0] = byte(v >> 24)
+	b[1] = byte(v >> 16)
+	b[2] = byte(v >> 8)
+	b[3] = byte(v)
+}
@@ -0,0 +1,169 @@
+/*
+ * Copyright (C) 2013-2015 Adrian Ulrich <adrian@blinkenlights.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package flickr
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+var uploadEndpoint = "https://up.flickr.com/services/upload/"
+var reOriginalUrl = regexp.MustCompile(`<img src="https?://([^"]+_o\.png)">`)
+var reConfigLine = regexp.MustCompile(`^\s*([a-zA-Z_]+)=(.+?)\s*$`)
+
+type Uploader struct {
+	conf       map[string]string // parsed ~/.flickrrc
+	httpClient *http.Client
+}
+
+type uploadResponse struct {
+	Stat    string `xml:"stat,attr"`
+	PhotoId string `xml:"photoid"`
+	Err     struct {
+		Code string `xml:"code,attr"`
+		Msg  string `xml:"msg,attr"`
+	} `xml:"err"`
+}
+
+// Returns a new Flickr uploader, configured by the (flickr_upload compatible) config file at confPath
+// The file must provide at least auth_token and url_prefix
+func NewUploader(confPath string) (*Uploader, error) {
+	fh, err := os.Open(confPath)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	u := new(Uploader)
+	u.conf = map[string]string{"key": "8dcf37880da64acfe8e30bb1091376b7", "secret": "2f3695d0562cdac7"}
+	u.httpClient = &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment}}
+
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if idx := strings.Index(line, "#"); idx != -1 {
+			line = line[:idx] // strip comments
+		}
+		if m := reConfigLine.FindStringSubmatch(line); m != nil {
+			u.conf[m[1]] = m[2]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if u.conf["auth_token"] == "" || u.conf["url_prefix"] == "" {
+		return nil, fmt.Errorf("%s must set auth_token and url_prefix", confPath)
+	}
+	return u, nil
+}
+
+// Uploads given PNG image and returns the URL of the original photo
+func (u *Uploader) Upload(blob io.Reader, size int64) (string, error) {
+	photoId, err := u.postPhoto(blob)
+	if err != nil {
+		return "", err
+	}
+	return u.getOriginalUrl(fmt.Sprintf("%s/%s/sizes/o/in/photostream/", u.conf["url_prefix"], photoId))
+}
+
+// Sends the image to the upload endpoint and returns the assigned photo id
+func (u *Uploader) postPhoto(blob io.Reader) (string, error) {
+	params := map[string]string{"api_key": u.conf["key"], "auth_token": u.conf["auth_token"]}
+	params["api_sig"] = u.sign(params)
+
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+	for k, v := range params {
+		mw.WriteField(k, v)
+	}
+	part, err := mw.CreateFormFile("photo", "blob.png")
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(part, blob); err != nil {
+		return "", err
+	}
+	if err := mw.Close(); err != nil {
+		return "", err
+	}
+
+	resp, err := u.httpClient.Post(uploadEndpoint, mw.FormDataContentType(), body)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	rsp := uploadResponse{}
+	err = xml.NewDecoder(resp.Body).Decode(&rsp)
+	if err != nil {
+		return "", err
+	}
+	if rsp.Stat != "ok" || rsp.PhotoId == "" {
+		return "", fmt.Errorf("upload failed: %s (code=%s)", rsp.Err.Msg, rsp.Err.Code)
+	}
+	return rsp.PhotoId, nil
+}
+
+// Attempts to grab the 'original photo' img-src from given url
+// Flickr needs some time to process new uploads, so we keep retrying for a while
+func (u *Uploader) getOriginalUrl(sizesUrl string) (string, error) {
+	for wait := 1; wait <= 60; wait++ {
+		resp, err := u.httpClient.Get(sizesUrl)
+		if err == nil {
+			html, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if m := reOriginalUrl.FindSubmatch(html); err == nil && m != nil {
+				return "http://" + string(m[1]), nil
+			}
+		}
+		fmt.Printf("# ..flickr still working, waiting %d second(s) (fetch of %s failed)\n", wait, sizesUrl)
+		time.Sleep(time.Duration(wait) * time.Second)
+	}
+	return "", errors.New("giving up on " + sizesUrl)
+}
+
+// Returns the api signature of given parameters
+func (u *Uploader) sign(params map[string]string) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	h := md5.New()
+	io.WriteString(h, u.conf["secret"])
+	for _, k := range keys {
+		io.WriteString(h, k+params[k])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
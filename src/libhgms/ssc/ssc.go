@@ -1,196 +1,617 @@
 package ssc
 
 import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"hash"
 	"hash/crc64"
-	"math/rand"
+	"io"
 	"os"
+	"sort"
+	"strings"
 	"sync"
+	"syscall"
 )
 
+// Crash consistency:
+// Each entry carries a generation number which is written to its key record
+// (together with the data) and to its metadata. A chunk is released by clearing
+// its metadata before new data gets written, and the metadata of the new entry
+// is written last. The superblock is marked as clean by Close(): if a database
+// was not closed, every entry gets verified (matching generation, key and
+// checksum) while opening it and broken entries are dropped.
+// The SyncPolicy of a Cache defines when changes are flushed to disk.
+//
+// Keys are looked up by a 128 bit hash, but the full key is stored as well:
+// a hash collision is detected and never returns the data of another key.
+
 var ErrCorruptedDb = errors.New("Database is corrupted")
+var ErrLocked = errors.New("Database is in use by another process")
+var ErrNotCached = errors.New("Key is not cached")
 
 var SUPER_MAGIC = [4]byte{'!', 's', 's', 'c'}
-var SUPER_VERSION = uint8(1)
+var SUPER_VERSION = uint8(4)
 
 const SUPERBLOCK_SIZE = 4096
 
+const (
+	STATE_CLEAN = uint8(0) // database was closed properly
+	STATE_OPEN  = uint8(1) // database is in use (or was not closed)
+)
+
 type Superblock struct {
 	Magic            [4]byte    // magic-4-byte sequence
 	Version          uint8      // revision of database layout
 	ChunkSize        uint32     // size in bytes of a single chunk
 	ChunkCount       uint32     // how many chunks this database is storing
-	ChunkPointerHint uint32     // next field we are going to use
-	Padding          [4079]byte // align to 4K
+	ChunkPointerHint uint32     // unused: the least recently used chunk gets overwritten
+	State            uint8      // STATE_CLEAN or STATE_OPEN
+	Hits             uint64     // number of successful lookups
+	Misses           uint64     // number of failed lookups
+	Padding          [4062]byte // align to 4K
 }
 
-const METAENTRY_SIZE = 8 + 4 + 4
+const METAENTRY_SIZE = 16 + 4 + 4 + 8 + 8 + 8
+
+type KeyHash [16]byte
 
 type MetaEntry struct {
-	Key      uint64 // crc64 key
-	Len      uint32 // lenght of this slice (might be < chunksize!)
-	Checksum uint32 // calculated on-disk checksum
+	Key        KeyHash // hash of the key
+	Len        uint32  // lenght of this slice (might be < chunksize!)
+	Checksum   uint64  // calculated on-disk checksum
+	Stamp      uint64  // logical time of the last access, 0 if the chunk is unused
+	Generation uint64  // must match the generation of the key record
+}
+
+const KEYENTRY_SIZE = 256                  // on-disk size of a key record: 8 bytes generation, 2 bytes length + the key itself
+const MAX_KEY_SIZE = KEYENTRY_SIZE - 8 - 2 // longest key we are able to store
+
+// Summary of a database, as returned by Stats()
+type Stats struct {
+	Version    uint8  // revision of the database layout
+	ChunkSize  uint32 // size in bytes of a single chunk
+	ChunkCount uint32 // how many chunks this database is storing
+	Used       uint32 // number of chunks holding an entry
+	UsedBytes  uint64 // size of all stored entries
+	Hits       uint64 // number of successful lookups
+	Misses     uint64 // number of failed lookups
 }
 
+// A single entry, as returned by Entries()
+type Entry struct {
+	Key   string // the key this entry was stored with
+	Len   uint32 // length of its data
+	Stamp uint64 // logical time of the last access
+}
+
+type SyncPolicy int
+
+const (
+	SYNC_CLOSE  = SyncPolicy(0) // flush changes on Close(): entries written since the last Close() may get lost on a crash
+	SYNC_WRITES = SyncPolicy(1) // flush each change before returning
+)
+
+var crcECMA = crc64.MakeTable(crc64.ECMA) // used for checksums
+
 type chunkmapEntry struct {
 	chunk uint32 // chunk index we are pointing to
 	dirty bool   // true if the on-disk data needs to be validated
 }
 
+// A Cache may be used by multiple goroutines at once: the mutex only protects
+// the in-memory structures, chunk data is read and written without holding it
 type Cache struct {
-	chunkSize  uint32                   // size in bytes of a single chunk
-	chunkCount uint32                   // amount of chunks we are storing
-	metaMap    []MetaEntry              // mapping of chunk -> MetaEntry
-	chunkMap   map[uint64]chunkmapEntry // mapping of hash -> chunk
-	nextChunk  uint32                   // next chunk to use for writing
-	hasher     hash.Hash64              // hasher implementation
-	fh         *os.File                 // filehandle pointing to our database
-	mutex      *sync.RWMutex            // cache-wide lock for io and slice operations
-	superBlock *Superblock              // reference to currently loaded superblock
+	Sync       SyncPolicy                // when to flush changes to disk, defaults to SYNC_CLOSE
+	chunkSize  uint32                    // size in bytes of a single chunk
+	chunkCount uint32                    // amount of chunks we are storing
+	metaMap    []MetaEntry               // mapping of chunk -> MetaEntry
+	keyMap     []string                  // mapping of chunk -> key
+	writeSeq   []uint64                  // mapping of chunk -> number of times it was released, readers use it to detect reuse
+	busy       []bool                    // mapping of chunk -> true while its data is being written
+	chunkMap   map[KeyHash]chunkmapEntry // mapping of hash -> chunk (used chunks only)
+	lru        *list.List                // all chunks, most recently used first
+	lruElems   []*list.Element           // mapping of chunk -> its element in lru
+	clock      uint64                    // stamp of the most recent access
+	generation uint64                    // generation of the most recently stored entry
+	fh         *os.File                  // filehandle pointing to our database
+	lockFh     *os.File                  // filehandle holding the exclusive lock, nil if not locked
+	mutex      *sync.Mutex               // cache-wide lock for slice and map operations
+	superBlock *Superblock               // reference to currently loaded superblock
 }
 
 // Returns an initialized Cache handle with sane defaults
+// The database is locked until the cache is closed, ErrLocked is returned if
+// someone else is using it
 func New(dbpath string, chunksize uint32, chunkcount uint32) (*Cache, error) {
-	c := &Cache{
+	c := newCache(chunksize, chunkcount)
+
+	lockFh, err := lockDb(dbpath)
+	if err != nil {
+		return c, err
+	}
+	c.lockFh = lockFh
+
+	err = c.openDbFile(dbpath)
+	if err != nil {
+		c.lockFh.Close()
+		c.lockFh = nil
+	}
+	return c, err
+}
+
+// Opens an existing database using the size it was created with
+func Open(dbpath string) (*Cache, error) {
+	fh, err := os.Open(dbpath)
+	if err != nil {
+		return nil, err
+	}
+	sb := &Superblock{}
+	err = binary.Read(io.NewSectionReader(fh, 0, SUPERBLOCK_SIZE), binary.LittleEndian, sb)
+	fh.Close()
+	if err != nil || sb.Magic != SUPER_MAGIC || sb.ChunkCount == 0 {
+		return nil, ErrCorruptedDb
+	}
+	return New(dbpath, sb.ChunkSize, sb.ChunkCount)
+}
+
+// Returns an empty Cache handle
+func newCache(chunksize uint32, chunkcount uint32) *Cache {
+	return &Cache{
 		chunkSize:  chunksize,
 		chunkCount: chunkcount,
 		metaMap:    make([]MetaEntry, chunkcount),
-		chunkMap:   make(map[uint64]chunkmapEntry, chunkcount),
-		nextChunk:  0,
-		hasher:     crc64.New(crc64.MakeTable(crc64.ISO)),
-		mutex:      &sync.RWMutex{},
+		keyMap:     make([]string, chunkcount),
+		writeSeq:   make([]uint64, chunkcount),
+		busy:       make([]bool, chunkcount),
+		chunkMap:   make(map[KeyHash]chunkmapEntry, chunkcount),
+		lru:        list.New(),
+		lruElems:   make([]*list.Element, chunkcount),
+		mutex:      &sync.Mutex{},
 		superBlock: nil,
 	}
-	err := c.openDbFile(dbpath)
-	return c, err
+}
+
+// Takes the exclusive lock of the database at dbpath
+func lockDb(dbpath string) (*os.File, error) {
+	fh, err := os.OpenFile(dbpath+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(fh.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		fh.Close()
+		if err == syscall.EWOULDBLOCK {
+			err = ErrLocked
+		}
+		return nil, err
+	}
+	return fh, nil
 }
 
 // Closes an open cache handle (that is: closing the filehandle pointing to the database)
+// All changes are flushed to disk and the database is marked as clean
 func (c *Cache) Close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.fh.Sync() == nil {
+		c.superBlock.State = STATE_CLEAN
+		if c.writeSuperblock() == nil {
+			c.fh.Sync()
+		}
+	}
 	c.fh.Close()
+
+	if c.lockFh != nil {
+		c.lockFh.Close() // releases the lock
+		c.lockFh = nil
+	}
 }
 
-// Adds a new key to the cache
+// Adds a new key to the cache, evicting the least recently used entry
 // returns false if the data was not added to the cache
 func (c *Cache) Add(key string, value []byte) bool {
-	kh := c.hash64([]byte(key))
+	return c.store(key, value, false)
+}
 
-	c.mutex.Lock()
-	_, addFail := c.chunkMap[kh]
+// Stores value at key, overwriting the existing value if any
+// returns false if the data was not added to the cache
+func (c *Cache) Replace(key string, value []byte) bool {
+	return c.store(key, value, true)
+}
 
-	if addFail == false {
-		// cache miss: we can write to the index of nextChunk
-		chunk := c.nextChunk
-		// this index will be changed -> update in-memory struct
-		oldMeta := c.metaMap[chunk]
-		newMeta := MetaEntry{Key: kh, Len: uint32(len(value)), Checksum: c.hash32(value)}
+// Removes key from the cache
+// returns false if the key did not exist
+func (c *Cache) Delete(key string) bool {
+	kh := keyHash([]byte(key))
 
-		c.replaceMeta(oldMeta.Key, newMeta, false)
+	c.mutex.Lock()
+	entry, ok := c.chunkMap[kh]
+	ok = ok && c.keyMap[entry.chunk] == key
+	if ok {
+		c.free(entry.chunk)
+	}
+	c.mutex.Unlock()
 
-		c.seekToData(chunk)
-		binary.Write(c.fh, binary.LittleEndian, value)
+	if ok {
+		c.flush()
+	}
+	return ok
+}
 
-		c.nextChunk++
-		if c.nextChunk >= c.chunkCount {
-			c.nextChunk = 0 // overflowed -> next chunk shall be 0
+// Removes all keys starting with prefix from the cache
+// returns the number of removed keys
+func (c *Cache) InvalidatePrefix(prefix string) int {
+	c.mutex.Lock()
+	removed := 0
+	for chunk := uint32(0); chunk < c.chunkCount; chunk++ {
+		if c.metaMap[chunk].Stamp != 0 && strings.HasPrefix(c.keyMap[chunk], prefix) {
+			c.free(chunk)
+			removed++
 		}
 	}
 	c.mutex.Unlock()
-	return !addFail
+
+	if removed > 0 {
+		c.flush()
+	}
+	return removed
 }
 
 // Performs a lookup of 'key' in the cache
 // 'ok' will be true if the data could be found in the cache
 func (c *Cache) Get(key string) (data []byte, ok bool) {
-	kh := c.hash64([]byte(key))
+	kh := keyHash([]byte(key))
 
-	c.mutex.RLock()
+	c.mutex.Lock()
 	chunkEntry, ok := c.chunkMap[kh]
+	if ok == false || c.keyMap[chunkEntry.chunk] != key {
+		c.superBlock.Misses++
+		c.mutex.Unlock()
+		return nil, false // not cached (or a hash collision: this is someone else's data)
+	}
+	chunk := chunkEntry.chunk
+	memMeta := c.metaMap[chunk]
+	seq := c.writeSeq[chunk]
+	c.mutex.Unlock()
 
-	if ok {
-		memMeta := c.metaMap[chunkEntry.chunk]
-		data = make([]byte, memMeta.Len)
-
-		c.seekToData(chunkEntry.chunk)
-		data = make([]byte, memMeta.Len)
-		binary.Read(c.fh, binary.LittleEndian, data)
-
-		if chunkEntry.dirty == true { // old data: verify on-disk checksum
-			calcChecksum := c.hash32(data)
-
-			if calcChecksum == memMeta.Checksum {
-				chunkEntry.dirty = false // passed -> do not re-verify
-				c.chunkMap[kh] = chunkEntry
-			} else {
-				fmt.Printf("Corrupted block detected: %d - Checksum %X != %X\n", chunkEntry.chunk, calcChecksum, memMeta.Checksum)
-				fakeKey := c.findFreeKey(0)
-				c.replaceMeta(kh, MetaEntry{Key: fakeKey}, true)
-				data = make([]byte, 0)
-				ok = false
-			}
+	data = make([]byte, memMeta.Len)
+	_, err := c.fh.ReadAt(data, c.dataOffset(chunk))
+	valid := err == nil
+	if valid && chunkEntry.dirty == true { // old data: verify on-disk checksum
+		valid = checksum(data) == memMeta.Checksum
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.writeSeq[chunk] != seq {
+		c.superBlock.Misses++
+		return make([]byte, 0), false // the chunk was reused while we were reading it
+	}
+	if valid == false {
+		fmt.Printf("Corrupted block detected: %d - %s (err=%v)\n", chunk, key, err)
+		c.free(chunk)
+		c.superBlock.Misses++
+		return make([]byte, 0), false
+	}
+	if chunkEntry.dirty == true {
+		chunkEntry.dirty = false // passed -> do not re-verify
+		c.chunkMap[kh] = chunkEntry
+	}
+	c.touch(chunk)
+	c.superBlock.Hits++
+	return data, true
+}
+
+// Returns a summary of the database
+func (c *Cache) Stats() Stats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	st := Stats{Version: c.superBlock.Version, ChunkSize: c.chunkSize, ChunkCount: c.chunkCount, Hits: c.superBlock.Hits, Misses: c.superBlock.Misses}
+	for _, entry := range c.chunkMap {
+		st.Used++
+		st.UsedBytes += uint64(c.metaMap[entry.chunk].Len)
+	}
+	return st
+}
+
+// Returns all entries, most recently used first
+// Unlike Get() this does not change the order of the entries
+func (c *Cache) Entries() []Entry {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entries := make([]Entry, 0, len(c.chunkMap))
+	for elem := c.lru.Front(); elem != nil; elem = elem.Next() {
+		chunk := elem.Value.(uint32)
+		if meta := c.metaMap[chunk]; meta.Stamp != 0 {
+			entries = append(entries, Entry{Key: c.keyMap[chunk], Len: meta.Len, Stamp: meta.Stamp})
 		}
 	}
+	return entries
+}
+
+// Reads the data of key and verifies its checksum
+// Returns ErrNotCached if the key does not exist and ErrCorruptedDb if the data is broken,
+// the entry is neither removed nor marked as recently used
+func (c *Cache) Verify(key string) error {
+	kh := keyHash([]byte(key))
+
+	c.mutex.Lock()
+	entry, ok := c.chunkMap[kh]
+	if ok == false || c.keyMap[entry.chunk] != key {
+		c.mutex.Unlock()
+		return ErrNotCached
+	}
+	meta, seq := c.metaMap[entry.chunk], c.writeSeq[entry.chunk]
+	c.mutex.Unlock()
+
+	_, err := c.readChunk(entry.chunk, meta)
 
-	c.mutex.RUnlock()
-	return
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.writeSeq[entry.chunk] != seq {
+		return ErrNotCached // removed while we were reading it
+	}
+	return err
 }
 
-func (c *Cache) replaceMeta(oldKey uint64, newMeta MetaEntry, dirty bool) {
-	chunk := c.chunkMap[oldKey].chunk
-	delete(c.chunkMap, oldKey)
-	c.chunkMap[newMeta.Key] = chunkmapEntry{chunk: chunk, dirty: dirty}
-	c.metaMap[chunk] = newMeta
+// Returns true if key and value can be stored in a single chunk
+func (c *Cache) fits(key string, value []byte) bool {
+	return len(key) <= MAX_KEY_SIZE && uint32(len(value)) <= c.chunkSize
+}
+
+// Writes value to the chunk of key (if the key - or its hash - exists) or
+// to the least recently used chunk. Existing keys are only overwritten if
+// replace is true
+func (c *Cache) store(key string, value []byte, replace bool) bool {
+	if c.fits(key, value) == false {
+		return false
+	}
+	kh := keyHash([]byte(key))
+	checksum := checksum(value)
+
+	// Grab a chunk: it is released first, so nobody is going to read its old
+	// data and marked as busy, so no other writer will pick it
+	c.mutex.Lock()
+	var chunk uint32
+	if entry, exists := c.chunkMap[kh]; exists {
+		if replace == false && c.keyMap[entry.chunk] == key {
+			c.mutex.Unlock()
+			return false
+		}
+		chunk = entry.chunk
+	} else {
+		elem := c.lru.Back()
+		for elem != nil && c.busy[elem.Value.(uint32)] {
+			elem = elem.Prev()
+		}
+		if elem == nil {
+			c.mutex.Unlock()
+			return false // all chunks are being written
+		}
+		chunk = elem.Value.(uint32)
+	}
+	c.free(chunk)
+	c.busy[chunk] = true
+	c.lru.MoveToFront(c.lruElems[chunk])
+	seq := c.writeSeq[chunk]
+	c.generation++
+	generation := c.generation
+	c.mutex.Unlock()
 
-	c.seekToMeta(chunk)
-	binary.Write(c.fh, binary.LittleEndian, newMeta)
+	_, err := c.fh.WriteAt(value, c.dataOffset(chunk))
+	if err == nil {
+		err = c.writeKey(chunk, key, generation)
+	}
 
-	if chunk%512 == 0 {
-		// We save this lazy and add some slack to (less likely) overwrite new data after reading the SB from disk
-		c.superBlock.ChunkPointerHint = c.nextChunk + 520
-		c.seekToSuperblock()
-		binary.Write(c.fh, binary.LittleEndian, c.superBlock)
+	c.mutex.Lock()
+	c.busy[chunk] = false
+	if err != nil || c.writeSeq[chunk] != seq {
+		c.mutex.Unlock()
+		return false // failed to write
+	}
+	if entry, exists := c.chunkMap[kh]; exists {
+		c.free(entry.chunk) // the key was stored by someone else in between: ours is newer
 	}
 
-	if len(c.chunkMap) != len(c.metaMap) || uint32(len(c.metaMap)) != c.chunkCount {
-		panic("Corrupted mapping!")
+	c.clock++
+	c.replaceMeta(chunk, MetaEntry{Key: kh, Len: uint32(len(value)), Checksum: checksum, Stamp: c.clock, Generation: generation})
+	c.keyMap[chunk] = key
+	c.chunkMap[kh] = chunkmapEntry{chunk: chunk, dirty: false}
+	c.lru.MoveToFront(c.lruElems[chunk])
+	c.mutex.Unlock()
+
+	c.flush()
+	return true
+}
+
+// Flushes all changes to disk if required by our SyncPolicy
+func (c *Cache) flush() {
+	if c.Sync == SYNC_WRITES {
+		c.fh.Sync()
 	}
 }
 
-// Returns a CRC32 sum of b
-func (c *Cache) hash64(b []byte) uint64 {
-	c.hasher.Reset()
-	c.hasher.Write(b)
-	return c.hasher.Sum64()
+// Marks chunk as the most recently used one
+// Must be called while holding the mutex
+func (c *Cache) touch(chunk uint32) {
+	c.clock++
+	meta := c.metaMap[chunk]
+	meta.Stamp = c.clock
+	c.replaceMeta(chunk, meta)
+	c.lru.MoveToFront(c.lruElems[chunk])
 }
 
-func (c *Cache) hash32(b []byte) uint32 {
-	return uint32(c.hash64(b))
+// Removes the entry stored in chunk, the chunk will be the next one to get reused
+// Must be called while holding the mutex
+func (c *Cache) free(chunk uint32) {
+	if oldMeta := c.metaMap[chunk]; oldMeta.Stamp != 0 {
+		delete(c.chunkMap, oldMeta.Key)
+		c.replaceMeta(chunk, MetaEntry{})
+	}
+	c.keyMap[chunk] = ""
+	c.writeSeq[chunk]++
+	c.lru.MoveToBack(c.lruElems[chunk])
 }
 
-// Seeks to the superblock file position
-func (c *Cache) seekToSuperblock() error {
-	_, err := c.fh.Seek(0, 0)
-	return err
+// Updates the in-memory and on-disk metadata of chunk
+// Must be called while holding the mutex
+func (c *Cache) replaceMeta(chunk uint32, newMeta MetaEntry) {
+	c.metaMap[chunk] = newMeta
+
+	buf := make([]byte, METAENTRY_SIZE)
+	copy(buf[0:], newMeta.Key[:])
+	binary.LittleEndian.PutUint32(buf[16:], newMeta.Len)
+	binary.LittleEndian.PutUint64(buf[24:], newMeta.Checksum)
+	binary.LittleEndian.PutUint64(buf[32:], newMeta.Stamp)
+	binary.LittleEndian.PutUint64(buf[40:], newMeta.Generation)
+	c.fh.WriteAt(buf, c.metaOffset(chunk))
+
+	if uint32(len(c.chunkMap)) > c.chunkCount || c.lru.Len() != int(c.chunkCount) {
+		panic("Corrupted mapping!")
+	}
 }
 
-// Seeks to given chunk-position in the metadata part
-func (c *Cache) seekToMeta(chunk uint32) error {
-	_, err := c.fh.Seek(int64(SUPERBLOCK_SIZE*1+METAENTRY_SIZE*chunk), 0)
+// Writes the key record of chunk to disk
+func (c *Cache) writeKey(chunk uint32, key string, generation uint64) error {
+	buf := make([]byte, KEYENTRY_SIZE)
+	binary.LittleEndian.PutUint64(buf, generation)
+	binary.LittleEndian.PutUint16(buf[8:], uint16(len(key)))
+	copy(buf[10:], key)
+	_, err := c.fh.WriteAt(buf, c.keyOffset(chunk))
 	return err
 }
 
-// Seeks to given chunk-position in the data part
-func (c *Cache) seekToData(chunk uint32) error {
-	_, err := c.fh.Seek(int64(SUPERBLOCK_SIZE*1+METAENTRY_SIZE*c.chunkCount+chunk*c.chunkSize), 0)
+// Writes the superblock to disk
+func (c *Cache) writeSuperblock() error {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, c.superBlock)
+	_, err := c.fh.WriteAt(buf.Bytes(), 0)
 	return err
 }
 
+// Returns the hash used to look up key
+func keyHash(key []byte) (kh KeyHash) {
+	sum := sha256.Sum256(key)
+	copy(kh[:], sum[:])
+	return kh
+}
+
+// Returns the checksum of the data b
+func checksum(b []byte) uint64 {
+	return crc64.Checksum(b, crcECMA)
+}
+
+// Returns the file position of given chunk in the metadata part
+func (c *Cache) metaOffset(chunk uint32) int64 {
+	return SUPERBLOCK_SIZE*1 + METAENTRY_SIZE*int64(chunk)
+}
+
+// Returns the file position of given chunk in the key part
+func (c *Cache) keyOffset(chunk uint32) int64 {
+	return SUPERBLOCK_SIZE*1 + METAENTRY_SIZE*int64(c.chunkCount) + KEYENTRY_SIZE*int64(chunk)
+}
+
+// Returns the file position of given chunk in the data part
+func (c *Cache) dataOffset(chunk uint32) int64 {
+	return SUPERBLOCK_SIZE*1 + (METAENTRY_SIZE+KEYENTRY_SIZE)*int64(c.chunkCount) + int64(chunk)*int64(c.chunkSize)
+}
+
+// Reads and verifies the data stored in chunk
+func (c *Cache) readChunk(chunk uint32, meta MetaEntry) ([]byte, error) {
+	data := make([]byte, meta.Len)
+	if _, err := c.fh.ReadAt(data, c.dataOffset(chunk)); err != nil {
+		return nil, err
+	}
+	if checksum(data) != meta.Checksum {
+		return nil, ErrCorruptedDb
+	}
+	return data, nil
+}
+
+// Calls fn for each valid entry, starting with the least recently used one
+// The order of the entries is not changed
+func (c *Cache) walk(fn func(key string, data []byte)) {
+	c.mutex.Lock()
+	chunks := make([]uint32, 0, len(c.chunkMap))
+	for elem := c.lru.Back(); elem != nil; elem = elem.Prev() {
+		if chunk := elem.Value.(uint32); c.metaMap[chunk].Stamp != 0 {
+			chunks = append(chunks, chunk)
+		}
+	}
+	c.mutex.Unlock()
+
+	for _, chunk := range chunks {
+		c.mutex.Lock()
+		meta, key, seq := c.metaMap[chunk], c.keyMap[chunk], c.writeSeq[chunk]
+		c.mutex.Unlock()
+		if meta.Stamp == 0 {
+			continue // removed in between
+		}
+
+		data, err := c.readChunk(chunk, meta)
+
+		c.mutex.Lock()
+		reused := c.writeSeq[chunk] != seq
+		c.mutex.Unlock()
+		if err == nil && reused == false {
+			fn(key, data)
+		}
+	}
+}
+
+// Copies all valid entries of the database at dbpath into a new database of
+// the given size, which then replaces the old one.
+// If the new database is smaller, the most recently used entries are kept
+func migrate(dbpath string, sb *Superblock, chunkSize uint32, chunkCount uint32) error {
+	old := newCache(sb.ChunkSize, sb.ChunkCount)
+	fh, err := os.Open(dbpath)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	old.fh = fh
+	old.superBlock = sb
+	if stat, err := fh.Stat(); err != nil || stat.Size() != old.dataOffset(old.chunkCount) {
+		return ErrCorruptedDb
+	}
+	old.loadEntries()
+
+	tmpPath := dbpath + ".resize"
+	os.Remove(tmpPath)
+	resized := newCache(chunkSize, chunkCount)
+	if err := resized.openDbFile(tmpPath); err != nil {
+		return err
+	}
+
+	found := 0
+	old.walk(func(key string, data []byte) {
+		found++
+		resized.Add(key, data) // fails if data does not fit into the new chunk size
+	})
+	kept := len(resized.chunkMap)
+	resized.superBlock.Hits, resized.superBlock.Misses = sb.Hits, sb.Misses
+	resized.Close()
+
+	if err := os.Rename(tmpPath, dbpath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	fmt.Printf("Resized cache %s from %dx%d bytes to %dx%d bytes, kept %d of %d entries\n",
+		dbpath, sb.ChunkCount, sb.ChunkSize, chunkCount, chunkSize, kept, found)
+	return nil
+}
+
 // Opens the ssc database file
 // A new file will be created if the specified path does not exist
 // The file will be initialized if the given file is 0 bytes (or did not exist)
+// or was written by an older version, and resized if it has another size
 func (c *Cache) openDbFile(dbpath string) error {
 	fh, err := os.OpenFile(dbpath, os.O_RDWR|os.O_CREATE, 0600)
 	if err != nil {
@@ -199,59 +620,145 @@ func (c *Cache) openDbFile(dbpath string) error {
 
 	stat, err := fh.Stat()
 	if err != nil {
+		fh.Close()
 		return err
 	}
 
-	var sb *Superblock
-	expectedDbSize := int64(SUPERBLOCK_SIZE*1 + METAENTRY_SIZE*c.chunkCount + c.chunkCount*c.chunkSize)
-	if stat.Size() == 0 {
-		// File was just created or empty -> we are adding a pristine superblock to it
-		sb = &Superblock{Magic: SUPER_MAGIC, Version: SUPER_VERSION, ChunkSize: c.chunkSize, ChunkCount: c.chunkCount}
-		binary.Write(fh, binary.LittleEndian, sb)
+	c.fh = fh
+	sb := &Superblock{}
+	expectedDbSize := c.dataOffset(c.chunkCount)
+	if stat.Size() >= SUPERBLOCK_SIZE {
+		binary.Read(io.NewSectionReader(fh, 0, SUPERBLOCK_SIZE), binary.LittleEndian, sb)
+		if sb.Magic == SUPER_MAGIC && sb.Version < SUPER_VERSION {
+			// Written by an older version, whose entries can not be looked up: start from scratch
+			fmt.Printf("Discarding cache %s with outdated version %d\n", dbpath, sb.Version)
+			stat = nil
+		}
+	}
+
+	if stat == nil || stat.Size() == 0 {
+		// File was just created, empty or outdated -> we are adding a pristine superblock to it
+		sb = &Superblock{Magic: SUPER_MAGIC, Version: SUPER_VERSION, ChunkSize: c.chunkSize, ChunkCount: c.chunkCount, State: STATE_CLEAN}
+		c.superBlock = sb
+		fh.Truncate(0)
+		c.writeSuperblock()
 		fh.Truncate(expectedDbSize)
-	} else if stat.Size() == expectedDbSize {
-		// Size looks sane, try to read superblock
-		sb = &Superblock{}
-		binary.Read(fh, binary.LittleEndian, sb)
-		if sb.Magic != SUPER_MAGIC || sb.Version != SUPER_VERSION || sb.ChunkSize != c.chunkSize || sb.ChunkCount != c.chunkCount {
-			fh.Close()
-			return ErrCorruptedDb
+	} else if sb.Magic == SUPER_MAGIC && sb.Version == SUPER_VERSION && (sb.ChunkSize != c.chunkSize || sb.ChunkCount != c.chunkCount) {
+		// Database has another size: carry its entries over into a new one
+		fh.Close()
+		if err := migrate(dbpath, sb, c.chunkSize, c.chunkCount); err != nil {
+			return err
 		}
-	} else {
-		// File existed but size was wrong: return an error
+		return c.openDbFile(dbpath)
+	} else if stat.Size() != expectedDbSize || sb.Magic != SUPER_MAGIC || sb.Version != SUPER_VERSION {
+		// File existed but size or superblock was wrong: return an error
 		fh.Close()
 		return ErrCorruptedDb
 	}
 
-	c.fh = fh
 	c.superBlock = sb
+	c.loadEntries()
+
+	if sb.State != STATE_CLEAN {
+		c.recoverEntries(dbpath)
+	}
+
+	// We are going to modify the database: a crash from now on requires a recovery
+	c.superBlock.State = STATE_OPEN
+	if err := c.writeSuperblock(); err != nil {
+		fh.Close()
+		return err
+	}
+	return c.fh.Sync()
+}
+
+// Maps metadata and keys into memory and rebuilds the lru list
+func (c *Cache) loadEntries() {
+	metaBuf := make([]byte, METAENTRY_SIZE*int64(c.chunkCount))
+	c.fh.ReadAt(metaBuf, c.metaOffset(0))
+	keyBuf := make([]byte, KEYENTRY_SIZE*int64(c.chunkCount))
+	c.fh.ReadAt(keyBuf, c.keyOffset(0))
 
-	// Map metadata into memory
 	for chunk := uint32(0); chunk < c.chunkCount; chunk++ {
-		c.seekToMeta(chunk)
-		mEnt := MetaEntry{}
-		binary.Read(c.fh, binary.LittleEndian, &mEnt)
+		mEnt := c.decodeMeta(metaBuf[METAENTRY_SIZE*int64(chunk):][:METAENTRY_SIZE])
+		if mEnt.Stamp == 0 {
+			continue
+		}
+
+		generation, key, ok := c.decodeKey(keyBuf[KEYENTRY_SIZE*int64(chunk):][:KEYENTRY_SIZE])
+		if ok == false || generation != mEnt.Generation || keyHash(key) != mEnt.Key {
+			continue // key record does not belong to this entry: drop it
+		}
+		if other, exists := c.chunkMap[mEnt.Key]; exists {
+			// the same key was stored twice: keep the most recent entry
+			if c.metaMap[other.chunk].Stamp > mEnt.Stamp {
+				continue
+			}
+			c.metaMap[other.chunk] = MetaEntry{}
+			c.keyMap[other.chunk] = ""
+		}
 
-		mEnt.Key = c.findFreeKey(mEnt.Key) // assigns a random key if this key already exists (causing a checksum fail)
-		c.chunkMap[mEnt.Key] = chunkmapEntry{chunk: chunk, dirty: true}
 		c.metaMap[chunk] = mEnt
+		c.keyMap[chunk] = string(key)
+		c.chunkMap[mEnt.Key] = chunkmapEntry{chunk: chunk, dirty: true}
+		if mEnt.Stamp > c.clock {
+			c.clock = mEnt.Stamp
+		}
+		if mEnt.Generation > c.generation {
+			c.generation = mEnt.Generation
+		}
 	}
 
-	if sb.ChunkPointerHint < c.chunkCount {
-		c.nextChunk = sb.ChunkPointerHint
+	// Rebuild the lru list: unused chunks (stamp 0) end up at its back
+	byStamp := make([]uint32, c.chunkCount)
+	for chunk := range byStamp {
+		byStamp[chunk] = uint32(chunk)
+	}
+	sort.Slice(byStamp, func(i, j int) bool { return c.metaMap[byStamp[i]].Stamp < c.metaMap[byStamp[j]].Stamp })
+	for _, chunk := range byStamp {
+		c.lruElems[chunk] = c.lru.PushFront(chunk)
 	}
-
-	return nil
 }
 
-// Returns a free key in chunkMap, tries to
-// return 'hint'
-func (c *Cache) findFreeKey(hint uint64) uint64 {
-	for {
-		if _, exists := c.chunkMap[hint]; exists == false {
-			break
+// Verifies all entries of a database which was not closed properly
+// and drops the broken ones
+func (c *Cache) recoverEntries(dbpath string) {
+	dropped := 0
+	for chunk := uint32(0); chunk < c.chunkCount; chunk++ {
+		if c.metaMap[chunk].Stamp == 0 {
+			continue
+		}
+		if _, err := c.readChunk(chunk, c.metaMap[chunk]); err != nil {
+			c.free(chunk)
+			dropped++
+		} else {
+			c.chunkMap[c.metaMap[chunk].Key] = chunkmapEntry{chunk: chunk, dirty: false}
 		}
-		hint = uint64(rand.Int63())
 	}
-	return hint
+	fmt.Printf("Recovered cache %s after unclean shutdown: %d entries verified, %d dropped\n", dbpath, len(c.chunkMap), dropped)
+}
+
+// Decodes a metadata entry, see replaceMeta
+func (c *Cache) decodeMeta(buf []byte) MetaEntry {
+	var m MetaEntry
+	copy(m.Key[:], buf[0:16])
+	m.Len = binary.LittleEndian.Uint32(buf[16:])
+	m.Checksum = binary.LittleEndian.Uint64(buf[24:])
+	m.Stamp = binary.LittleEndian.Uint64(buf[32:])
+	m.Generation = binary.LittleEndian.Uint64(buf[40:])
+	if m.Len > c.chunkSize {
+		m.Stamp = 0 // impossible length: treat as unused
+	}
+	return m
+}
+
+// Decodes a key record, see writeKey. Returns false if it is invalid
+func (c *Cache) decodeKey(buf []byte) (generation uint64, key []byte, ok bool) {
+	generation = binary.LittleEndian.Uint64(buf)
+	buf = buf[8:]
+	keyLen := int(binary.LittleEndian.Uint16(buf))
+	if keyLen > len(buf)-2 {
+		return 0, nil, false
+	}
+	return generation, buf[2 : 2+keyLen], true
 }
@@ -0,0 +1,360 @@
+package ssc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Returns a new cache in a temporary directory, which is removed by the returned function
+func tempCache(t *testing.T, chunkSize uint32, chunkCount uint32) (*Cache, string, func()) {
+	dir, err := ioutil.TempDir("", "ssc-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbpath := filepath.Join(dir, "cache.db")
+	c, err := New(dbpath, chunkSize, chunkCount)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return c, dbpath, func() { os.RemoveAll(dir) }
+}
+
+// Returns a value of the given length which can be told apart from the value of any other key and version
+func testValue(key string, version int, length int) []byte {
+	pattern := []byte(fmt.Sprintf("%s|%d|", key, version))
+	return bytes.Repeat(pattern, length/len(pattern)+1)[:length]
+}
+
+// Returns true if data was created by testValue for key
+func validValue(key string, data []byte) bool {
+	var version int
+	if _, err := fmt.Sscanf(strings.TrimPrefix(string(data), key+"|"), "%d|", &version); err != nil {
+		return false
+	}
+	return bytes.Equal(data, testValue(key, version, len(data)))
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	c, dbpath, cleanup := tempCache(t, 4096, 64)
+	defer cleanup()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(int64(g)))
+			for i := 0; i < 2000; i++ {
+				key := fmt.Sprintf("p%d/k%d", rnd.Intn(4), rnd.Intn(32))
+				switch op := rnd.Intn(100); {
+				case op < 50:
+					if data, ok := c.Get(key); ok && validValue(key, data) == false {
+						t.Errorf("Get(%s) returned wrong data", key)
+						return
+					}
+				case op < 70:
+					c.Add(key, testValue(key, g*10000+i, 100+rnd.Intn(3996)))
+				case op < 90:
+					c.Replace(key, testValue(key, g*10000+i, 100+rnd.Intn(3996)))
+				case op < 98:
+					c.Delete(key)
+				default:
+					c.InvalidatePrefix(key[:3])
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if st := c.Stats(); st.Used > st.ChunkCount {
+		t.Fatalf("%d of %d chunks are used", st.Used, st.ChunkCount)
+	}
+	c.Close()
+
+	// Everything we kept must survive reopening the database
+	c, err := Open(dbpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for _, entry := range c.Entries() {
+		if err := c.Verify(entry.Key); err != nil {
+			t.Errorf("Verify(%s) failed: %s", entry.Key, err)
+		}
+		if data, ok := c.Get(entry.Key); ok == false || validValue(entry.Key, data) == false {
+			t.Errorf("Get(%s) failed after reopening", entry.Key)
+		}
+	}
+}
+
+// A reader must never return the data of another key, even if the chunk it
+// is reading from gets reused in between
+func TestGetWhileChunkIsReused(t *testing.T) {
+	const chunkSize = 256 * 1024
+	c, _, cleanup := tempCache(t, chunkSize, 1)
+	defer cleanup()
+	defer c.Close()
+
+	keys := []string{"a", "b"}
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 400; i++ {
+			key := keys[i%2]
+			c.Add(key, testValue(key, i, chunkSize)) // evicts the other key
+		}
+	}()
+
+	hits := 0
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		for _, key := range keys {
+			data, ok := c.Get(key)
+			if ok && validValue(key, data) == false {
+				t.Fatalf("Get(%s) returned the data of another entry", key)
+			}
+			if ok {
+				hits++
+			}
+		}
+	}
+	t.Logf("%d hits", hits)
+}
+
+// Returns the keys of all entries, most recently used first
+func entryKeys(c *Cache) []string {
+	keys := []string{}
+	for _, entry := range c.Entries() {
+		keys = append(keys, entry.Key)
+	}
+	return keys
+}
+
+// Returns the state stored in the superblock of the database at dbpath
+func diskState(t *testing.T, dbpath string) uint8 {
+	fh, err := os.Open(dbpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	sb := &Superblock{}
+	if err := binary.Read(fh, binary.LittleEndian, sb); err != nil {
+		t.Fatal(err)
+	}
+	return sb.State
+}
+
+// Closes the database without marking it as clean, as if the process died
+func crash(c *Cache) {
+	c.fh.Close()
+	c.lockFh.Close()
+}
+
+func TestLruOrder(t *testing.T) {
+	c, _, cleanup := tempCache(t, 64, 3)
+	defer cleanup()
+	defer c.Close()
+
+	for _, key := range []string{"a", "b", "c"} {
+		c.Add(key, testValue(key, 0, 64))
+	}
+	c.Get("a")
+	c.Add("d", testValue("d", 0, 64)) // evicts b
+
+	if keys := strings.Join(entryKeys(c), ","); keys != "d,a,c" {
+		t.Fatalf("entries are %s, expected d,a,c", keys)
+	}
+	if _, ok := c.Get("b"); ok {
+		t.Fatalf("least recently used entry was not evicted")
+	}
+}
+
+func TestDeleteReplaceInvalidate(t *testing.T) {
+	c, _, cleanup := tempCache(t, 64, 8)
+	defer cleanup()
+	defer c.Close()
+
+	for _, key := range []string{"x/1", "x/2", "y/1"} {
+		if c.Add(key, testValue(key, 0, 32)) == false {
+			t.Fatalf("Add(%s) failed", key)
+		}
+	}
+	if c.Add("x/1", testValue("x/1", 1, 32)) {
+		t.Fatalf("Add overwrote an existing key")
+	}
+	if c.Replace("x/1", testValue("x/1", 1, 48)) == false {
+		t.Fatalf("Replace failed")
+	}
+	if data, _ := c.Get("x/1"); bytes.Equal(data, testValue("x/1", 1, 48)) == false {
+		t.Fatalf("Get returned %q after Replace", data)
+	}
+
+	if c.Delete("y/1") == false || c.Delete("y/1") == true {
+		t.Fatalf("Delete did not remove the key exactly once")
+	}
+	if n := c.InvalidatePrefix("x/"); n != 2 {
+		t.Fatalf("InvalidatePrefix removed %d entries, expected 2", n)
+	}
+	if st := c.Stats(); st.Used != 0 || st.UsedBytes != 0 {
+		t.Fatalf("%d entries with %d bytes left", st.Used, st.UsedBytes)
+	}
+}
+
+func TestHashCollision(t *testing.T) {
+	c, dbpath, cleanup := tempCache(t, 64, 4)
+	defer cleanup()
+
+	c.Add("a", testValue("a", 0, 64))
+
+	// Let "b" share the hash of "a": only the stored key tells them apart
+	c.mutex.Lock()
+	c.chunkMap[keyHash([]byte("b"))] = c.chunkMap[keyHash([]byte("a"))]
+	c.mutex.Unlock()
+	if _, ok := c.Get("b"); ok {
+		t.Fatalf("Get returned the data of a colliding key")
+	}
+	if c.Verify("b") != ErrNotCached || c.Delete("b") {
+		t.Fatalf("colliding key was treated as cached")
+	}
+	if data, ok := c.Get("a"); ok == false || validValue("a", data) == false {
+		t.Fatalf("Get of the original key failed")
+	}
+	c.mutex.Lock()
+	delete(c.chunkMap, keyHash([]byte("b")))
+	c.mutex.Unlock()
+
+	// A key record which does not match the hash of its entry is dropped while loading
+	chunk := c.chunkMap[keyHash([]byte("a"))].chunk
+	if err := c.writeKey(chunk, "b", c.metaMap[chunk].Generation); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	c, err := Open(dbpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if len(c.Entries()) != 0 {
+		t.Fatalf("entries with a foreign key record were loaded: %v", entryKeys(c))
+	}
+}
+
+func TestDiscardVersion1(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssc-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dbpath := filepath.Join(dir, "cache.db")
+
+	// version 1 stored 24 byte metadata entries and no keys at all
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, &Superblock{Magic: SUPER_MAGIC, Version: 1, ChunkSize: 64, ChunkCount: 4})
+	buf.Write(bytes.Repeat([]byte{0xff}, (24+64)*4))
+	if err := ioutil.WriteFile(dbpath, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := New(dbpath, 64, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if st := c.Stats(); st.Version != SUPER_VERSION || st.Used != 0 {
+		t.Fatalf("got version %d with %d entries", st.Version, st.Used)
+	}
+	if stat, err := os.Stat(dbpath); err != nil || stat.Size() != c.dataOffset(4) {
+		t.Fatalf("database was not reinitialized: %v", err)
+	}
+	if c.Add("a", testValue("a", 0, 64)) == false {
+		t.Fatalf("Add failed")
+	}
+}
+
+func TestResize(t *testing.T) {
+	c, dbpath, cleanup := tempCache(t, 64, 4)
+	defer cleanup()
+
+	for _, key := range []string{"a", "b", "c", "d"} {
+		c.Add(key, testValue(key, 0, 16+len(key)*8))
+	}
+	c.Add("big", testValue("big", 0, 64))
+	c.Get("b") // entries are now b, big, d, c
+	c.Close()
+
+	// A smaller database keeps the most recently used entries
+	c, err := New(dbpath, 64, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := strings.Join(entryKeys(c), ","); keys != "b,big" {
+		t.Fatalf("entries are %s after shrinking, expected b,big", keys)
+	}
+	c.Close()
+
+	// Entries which do not fit into the new chunk size are dropped
+	c, err = New(dbpath, 32, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if keys := strings.Join(entryKeys(c), ","); keys != "b" {
+		t.Fatalf("entries are %s after changing the chunk size, expected b", keys)
+	}
+	if data, ok := c.Get("b"); ok == false || validValue("b", data) == false {
+		t.Fatalf("Get failed after resizing")
+	}
+	if st := c.Stats(); st.ChunkSize != 32 || st.ChunkCount != 8 {
+		t.Fatalf("database has %dx%d bytes", st.ChunkCount, st.ChunkSize)
+	}
+}
+
+func TestRecoverAfterCrash(t *testing.T) {
+	c, dbpath, cleanup := tempCache(t, 64, 4)
+	defer cleanup()
+
+	for _, key := range []string{"a", "b", "c"} {
+		c.Add(key, testValue(key, 0, 64))
+	}
+	broken := c.chunkMap[keyHash([]byte("b"))].chunk
+	if _, err := c.fh.WriteAt([]byte("garbage"), c.dataOffset(broken)); err != nil {
+		t.Fatal(err)
+	}
+	crash(c)
+
+	if state := diskState(t, dbpath); state != STATE_OPEN {
+		t.Fatalf("database is in state %d after a crash", state)
+	}
+
+	c, err := Open(dbpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := strings.Join(entryKeys(c), ","); keys != "c,a" {
+		t.Fatalf("entries are %s after recovery, expected c,a", keys)
+	}
+	for _, key := range []string{"a", "c"} {
+		if data, ok := c.Get(key); ok == false || validValue(key, data) == false {
+			t.Fatalf("Get(%s) failed after recovery", key)
+		}
+	}
+	c.Close()
+
+	if state := diskState(t, dbpath); state != STATE_CLEAN {
+		t.Fatalf("database is in state %d after closing it", state)
+	}
+}
@@ -35,6 +35,12 @@ type HgmStatDirent struct {
 	IsDir bool   `json:"IsDir"`
 }
 
+// A directory entry together with its attributes, as returned by op=readdirplus
+type HgmStatDirentPlus struct {
+	Name string      `json:"Name"`
+	Attr HgmStatAttr `json:"Attr"`
+}
+
 type HgmStatAttr struct {
 	Inode     uint64
 	Size      uint64
@@ -51,11 +57,14 @@ type HgmStatAttr struct {
 }
 
 type JsonMeta struct {
-	Location    [][]string
-	Key         string
-	Created     int64
-	ContentSize uint64
-	BlobSize    int64
+	Location      [][]string
+	Key           string
+	Created       int64
+	ContentSize   uint64
+	BlobSize      int64
+	Version       int      `json:",omitempty"` // encryption format, see aestool
+	ContentSha256 string   `json:",omitempty"` // hex encoded SHA-256 of the whole content
+	PartSha256    []string `json:",omitempty"` // hex encoded SHA-256 of each part, in blob order
 }
 
 // Calls readdir on a local path, returns an array of HgmStatDirent entries
@@ -78,6 +87,24 @@ func LocalReadDir(path string) ([]HgmStatDirent, error) {
 	return dirList, nil
 }
 
+// Calls readdir on a local path and stats each entry, returns an array of HgmStatDirentPlus entries
+// Entries which vanished in between are skipped
+func LocalReadDirPlus(path string) ([]HgmStatDirentPlus, error) {
+	dirList, err := LocalReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	dirPlusList := make([]HgmStatDirentPlus, 0, len(dirList))
+	for _, dirent := range dirList {
+		attr, err := LocalStat(path + "/" + dirent.Name)
+		if err == nil {
+			dirPlusList = append(dirPlusList, HgmStatDirentPlus{Name: dirent.Name, Attr: *attr})
+		}
+	}
+	return dirPlusList, nil
+}
+
 // Stats a local (json) file
 func LocalStat(path string) (*HgmStatAttr, error) {
 	stat := syscall.Stat_t{}
@@ -89,8 +116,8 @@ func LocalStat(path string) (*HgmStatAttr, error) {
 
 	// Drops all non-permission flags
 	modePerm := (stat.Mode & uint32(os.ModePerm))
-	// and kill all write bits -> we are read only
-	modePerm &= 0555
+	// and all write bits except for the owner
+	modePerm &= 0755
 
 	isDir := false
 	if (stat.Mode & syscall.S_IFMT) == syscall.S_IFDIR {
@@ -164,6 +191,14 @@ func SysErrToHttpStatus(syserr error) int {
 		return 404
 	case syscall.EACCES:
 		return 405
+	case syscall.ENOTEMPTY:
+		return 409
+	case syscall.EROFS:
+		return 501
+	case syscall.EXDEV:
+		return 502
+	case syscall.ESTALE:
+		return 412
 	}
 	return 500
 }
@@ -179,6 +214,14 @@ func HttpStatusToFuseErr(status int) error {
 		return fuse.ENOENT
 	case 405:
 		return fuse.EPERM // fuse has no EACCES ?
+	case 409:
+		return fuse.Errno(syscall.ENOTEMPTY)
+	case 501:
+		return fuse.Errno(syscall.EROFS)
+	case 502:
+		return fuse.Errno(syscall.EXDEV)
+	case 412:
+		return fuse.Errno(syscall.ESTALE)
 	}
 	return fuse.EIO
 }
@@ -0,0 +1,227 @@
+/*
+ * Copyright (C) 2015 Adrian Ulrich <adrian@blinkenlights.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package uploadtool
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"libhgms/backend"
+	"libhgms/crypto/aestool"
+	"libhgms/flickr/png"
+	"libhgms/stattool"
+	mrand "math/rand"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	KeySize     = 256 / 8          // we are using aes-256
+	IVSize      = 16               // aes block size
+	MaxBlobSize = 1024 * 1024 * 16 // upper limit of a single blob
+)
+
+type UploadTool struct {
+	backend    backend.Backend
+	MaxRetries int           // how often a failed upload is retried, -1 retries forever
+	RetryDelay time.Duration // time to wait between two attempts
+	Layout     string        // PNG layout of new blobs, see flickr.LAYOUT_STORED
+}
+
+// Returns a new uploadtool instance which stores its blobs in the given backend
+func New(be backend.Backend) *UploadTool {
+	return &UploadTool{backend: be, MaxRetries: 0, RetryDelay: 10 * time.Second, Layout: flickr.LAYOUT_ZLIB}
+}
+
+// Returns a prototype of the metadata for a new file with contentSize bytes.
+// The prototype uses a random key and blob size and has no locations yet
+func NewMeta(contentSize int64) (*stattool.JsonMeta, error) {
+	key, err := RandomBytes(KeySize)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := &stattool.JsonMeta{
+		Location:    [][]string{},
+		Key:         hex.EncodeToString(key),
+		Created:     time.Now().Unix(),
+		ContentSize: uint64(contentSize),
+		BlobSize:    int64(MaxBlobSize/2 + mrand.Intn(MaxBlobSize/2)),
+		Version:     aestool.VERSION_GCM,
+	}
+	return meta, nil
+}
+
+var ErrContentChanged = errors.New("Content does not match the digest stored in the metadata")
+
+// Splits the content of src into meta.BlobSize sized parts, encrypts and uploads them.
+// The list of uploaded parts is added as a new replica to meta.Location on success,
+// a replica of empty content has no parts.
+// The digests of the content are recorded in meta, existing digests must match
+func (self *UploadTool) AddReplica(meta *stattool.JsonMeta, src io.Reader) error {
+	key, err := hex.DecodeString(meta.Key)
+	if err != nil || len(key) != KeySize {
+		return errors.New("Invalid key in metadata")
+	}
+	if meta.BlobSize < 1 {
+		return errors.New("Invalid blob size in metadata")
+	}
+
+	remoteParts := make([]string, 0)
+	partDigests := make([]string, 0)
+	contentHash := sha256.New()
+	contentSize := int64(meta.ContentSize)
+	for done := int64(0); done < contentSize; {
+		partSize := contentSize - done
+		if partSize > meta.BlobSize {
+			partSize = meta.BlobSize
+		}
+
+		part := make([]byte, partSize)
+		if _, err := io.ReadFull(src, part); err != nil {
+			self.deleteParts(remoteParts)
+			return err
+		}
+		contentHash.Write(part)
+		partDigest := sha256.Sum256(part)
+		partDigests = append(partDigests, hex.EncodeToString(partDigest[:]))
+
+		// Replicas must hold the same data: do not upload anything else
+		if idx := len(remoteParts); idx < len(meta.PartSha256) && meta.PartSha256[idx] != partDigests[idx] {
+			self.deleteParts(remoteParts)
+			return ErrContentChanged
+		}
+
+		// Each part gets its own IV: GCM must never see the same key and IV twice
+		iv, err := RandomBytes(IVSize)
+		if err != nil {
+			self.deleteParts(remoteParts)
+			return err
+		}
+
+		fmt.Printf("[part %d] encrypting+convert", len(remoteParts))
+		pngBuf := new(bytes.Buffer)
+		err = flickr.EncodeBlob(pngBuf, bytes.NewReader(part), self.Layout, meta.Version, key, iv, len(remoteParts), contentSize, partSize)
+		if err != nil {
+			self.deleteParts(remoteParts)
+			return err
+		}
+
+		fmt.Printf(" upload")
+		location, err := self.upload(pngBuf.Bytes())
+		if err != nil {
+			self.deleteParts(remoteParts)
+			return err
+		}
+		fmt.Printf(" ok!\n")
+
+		remoteParts = append(remoteParts, location)
+		done += partSize
+	}
+
+	contentDigest := hex.EncodeToString(contentHash.Sum(nil))
+	if meta.ContentSha256 != "" && meta.ContentSha256 != contentDigest {
+		self.deleteParts(remoteParts)
+		return ErrContentChanged
+	}
+
+	meta.Location = append(meta.Location, remoteParts)
+	meta.ContentSha256 = contentDigest
+	meta.PartSha256 = partDigests
+	return nil
+}
+
+// Removes already uploaded parts of a failed replica, errors are ignored
+// as not all backends support this
+func (self *UploadTool) deleteParts(locations []string) {
+	for _, location := range locations {
+		self.backend.Delete(location)
+	}
+}
+
+// Uploads blob, retrying failed uploads as configured
+func (self *UploadTool) upload(blob []byte) (location string, err error) {
+	for attempt := 0; ; attempt++ {
+		location, err = self.backend.Put(bytes.NewReader(blob), int64(len(blob)))
+		if err == nil || (self.MaxRetries >= 0 && attempt >= self.MaxRetries) {
+			break
+		}
+		fmt.Printf("# OUCH! upload failed with '%s', will retry in %s\n", err, self.RetryDelay)
+		time.Sleep(self.RetryDelay)
+	}
+	return
+}
+
+// Reads the json metadata stored at path
+func ReadMeta(path string) (*stattool.JsonMeta, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := &stattool.JsonMeta{}
+	err = json.Unmarshal(content, meta)
+	if err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// Atomically replaces the json metadata at path, missing parent directories are created
+func WriteMeta(path string, meta *stattool.JsonMeta) error {
+	jsonBlob, err := json.MarshalIndent(meta, "", "   ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	tmpFh, err := ioutil.TempFile(filepath.Dir(path), ".hgmupload")
+	if err != nil {
+		return err
+	}
+	_, err = tmpFh.Write(append(jsonBlob, '\n'))
+	if cerr := tmpFh.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		os.Chmod(tmpFh.Name(), 0644)
+		err = os.Rename(tmpFh.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmpFh.Name())
+	}
+	return err
+}
+
+// Returns size bytes from the system's secure random source
+func RandomBytes(size int) ([]byte, error) {
+	b := make([]byte, size)
+	_, err := io.ReadFull(rand.Reader, b)
+	return b, err
+}